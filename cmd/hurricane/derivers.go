@@ -0,0 +1,22 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package main // import "github.com/solnx/hurricane/cmd/hurricane"
+
+// Derivers compiled into hurricane. Importing a deriver package
+// registers its factory with the deriver registry.
+import (
+	_ "github.com/solnx/hurricane/internal/cpu"
+	_ "github.com/solnx/hurricane/internal/ctx"
+	_ "github.com/solnx/hurricane/internal/disk"
+	_ "github.com/solnx/hurricane/internal/mem"
+	_ "github.com/solnx/hurricane/internal/netif"
+	_ "github.com/solnx/hurricane/internal/rule"
+)
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
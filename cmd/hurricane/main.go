@@ -25,7 +25,12 @@ import (
 	"github.com/mjolnir42/delay"
 	"github.com/mjolnir42/erebos"
 	metrics "github.com/rcrowley/go-metrics"
+	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/hurricane/internal/config"
+	"github.com/solnx/hurricane/internal/deadletter"
 	"github.com/solnx/hurricane/internal/hurricane"
+	"github.com/solnx/hurricane/internal/lookup"
+	"github.com/solnx/hurricane/internal/registry"
 	"github.com/solnx/legacy"
 )
 
@@ -69,6 +74,17 @@ func main() {
 	if err := conf.FromFile(cliConfPath); err != nil {
 		logrus.Fatalf("Could not open configuration: %s", err)
 	}
+	settings := config.Config{}
+	if err := settings.FromFile(cliConfPath); err != nil {
+		logrus.Fatalf("Could not open configuration: %s", err)
+	}
+	policy, err := lookup.ParsePolicy(settings.Hurricane.LookupFailurePolicy)
+	if err != nil {
+		logrus.Fatalf("Invalid configuration: %s", err)
+	}
+	if err = registry.Check(settings.Enabled(&conf)); err != nil {
+		logrus.Fatalf("Invalid configuration: %s", err)
+	}
 
 	// setup logfile
 	if lfh, err := reopen.NewFileWriter(
@@ -136,6 +152,25 @@ func main() {
 		}()
 	}
 
+	// setup the tag lookup shared by all handlers
+	tagLookup := lookup.NewCache(
+		wall.NewLookup(&conf, `hurricane`),
+		settings.Hurricane.LookupCacheSize,
+		time.Duration(settings.Hurricane.LookupCacheTTL)*time.Second,
+		policy,
+		pfxRegistry,
+	)
+
+	// setup the dead letter spool shared by all handlers
+	var spool *deadletter.Spool
+	if settings.Hurricane.DeadLetterSpool != `` {
+		if spool, err = deadletter.OpenSpool(
+			settings.Hurricane.DeadLetterSpool,
+		); err != nil {
+			logrus.Fatalf("Unable to open dead letter spool: %s", err)
+		}
+	}
+
 	// start application handlers
 	for i := 0; i < runtime.NumCPU(); i++ {
 		h := hurricane.Hurricane{
@@ -146,6 +181,9 @@ func main() {
 			Death:    handlerDeath,
 			Config:   &conf,
 			Metrics:  &pfxRegistry,
+			Settings: &settings,
+			Lookup:   tagLookup,
+			Spool:    spool,
 		}
 		hurricane.Handlers[i] = &h
 		waitdelay.Use()
@@ -224,6 +262,11 @@ drainloop:
 	// give goroutines that were blocked on handlerDeath channel
 	// a chance to exit
 	waitdelay.Wait()
+	if spool != nil {
+		if err := spool.Close(); err != nil {
+			logrus.Errorf("Could not close dead letter spool: %s", err)
+		}
+	}
 	logrus.Infoln(`HURRICANE shutdown complete`)
 	if fault {
 		os.Exit(1)
@@ -0,0 +1,170 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+// Package config provides the hurricane application settings that are
+// not part of erebos.Config
+package config // import "github.com/solnx/hurricane/internal/config"
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/mjolnir42/erebos"
+	ucl "github.com/nahanni/go-ucl"
+)
+
+// Config holds the hurricane specific runtime configuration. It is
+// read from the same configuration file as erebos.Config.
+type Config struct {
+	Hurricane struct {
+		// number of tag lookups cached per process
+		LookupCacheSize int `json:"lookup.cache.size,string"`
+		// seconds a tag lookup is cached
+		LookupCacheTTL int `json:"lookup.cache.ttl.seconds,string"`
+		// handling of tag lookup failures: fail, untagged,
+		// last-known, retry
+		LookupFailurePolicy string `json:"lookup.failure.policy"`
+		// number of derived metrics each handler holds for the
+		// retry policy
+		LookupRetryBuffer int `json:"lookup.retry.buffer.size,string"`
+		// Kafka topic rejected input messages are produced to as
+		// dead letters, disabled if unset
+		DeadLetterTopic string `json:"deadletter.topic"`
+		// file rejected input messages are appended to as dead
+		// letters, disabled if unset
+		DeadLetterSpool string `json:"deadletter.spool.file"`
+		// directory to store deriver state snapshots in, snapshots
+		// are disabled if unset
+		StateDirectory string `json:"state.directory"`
+		// interval in seconds in which derivers implementing
+		// intf.Ticker are called, defaults to 10 seconds
+		TickInterval int `json:"tick.interval.seconds,string"`
+		// names of the enabled derivers. If unset, the derivers
+		// are enabled via the derive.*.metrics switches.
+		EnabledDerivers []string `json:"enabled.derivers"`
+		// per deriver settings, indexed by deriver name
+		Derivers map[string]Deriver `json:"derivers"`
+		// rules of the generic rule deriver, it is disabled if
+		// there are no rules
+		Rules []Rule `json:"rules"`
+	} `json:"hurricane"`
+}
+
+// Deriver holds the settings for a single deriver
+type Deriver struct {
+	// seconds without updates after which an asset is evicted from
+	// the deriver, eviction is disabled if unset
+	IdleTTL int `json:"idle.ttl.seconds,string"`
+	// seconds after which an incomplete distribution is given up,
+	// incomplete distributions are kept forever if unset
+	CompletionTimeout int `json:"completion.timeout.seconds,string"`
+	// how to handle incomplete distributions after the completion
+	// timeout: drop, partial
+	IncompletePolicy string `json:"incomplete.policy"`
+	// maximum timespan in seconds of measurement cycles that are
+	// assembled at the same time per asset
+	ReorderWindow int `json:"reorder.window.seconds,string"`
+	// maximum number of measurement cycles that are assembled at the
+	// same time per asset. If neither window nor cycles are set, a
+	// single cycle is assembled.
+	ReorderCycles int `json:"reorder.window.cycles,string"`
+	// deriver specific options
+	Options map[string]string `json:"options"`
+}
+
+// Rule describes a derived metric that is calculated by the generic
+// rule deriver from one or more input metrics
+type Rule struct {
+	// unique name of the rule
+	Name string `json:"name"`
+	// metric paths the rule is calculated from
+	Inputs []string `json:"inputs"`
+	// index of the metric tag that groups the inputs, for example 0
+	// for the mountpoint of disk metrics. Inputs are only grouped by
+	// asset if unset.
+	GroupTag string `json:"group.tag"`
+	// operation: rate, delta, ratio, sum, percent-of
+	Operation string `json:"operation"`
+	// path of the derived metric. If the inputs are grouped, the
+	// group is appended as :<group>
+	Path string `json:"output.path"`
+	// unit of the derived metric
+	Unit string `json:"output.unit"`
+	// type of the derived metric: real, integer
+	Type string `json:"output.type"`
+}
+
+// Deriver returns the settings for the deriver name. The zero value
+// is returned for derivers without settings.
+func (c *Config) Deriver(name string) Deriver {
+	if c == nil || c.Hurricane.Derivers == nil {
+		return Deriver{}
+	}
+	return c.Hurricane.Derivers[name]
+}
+
+// Enabled returns the names of the enabled derivers in the order they
+// should be started. Without an explicit list of enabled derivers,
+// the builtin derivers are enabled via the switches in conf and the
+// rule deriver is enabled if there are rules.
+func (c *Config) Enabled(conf *erebos.Config) []string {
+	if c != nil && len(c.Hurricane.EnabledDerivers) > 0 {
+		return c.Hurricane.EnabledDerivers
+	}
+
+	enabled := []string{}
+	for _, d := range []struct {
+		name string
+		on   bool
+	}{
+		{`ctx`, conf.Hurricane.DeriveCTX},
+		{`cpu`, conf.Hurricane.DeriveCPU},
+		{`mem`, conf.Hurricane.DeriveMEM},
+		{`disk`, conf.Hurricane.DeriveDISK},
+		{`netif`, conf.Hurricane.DeriveNETIF},
+		{`rule`, c != nil && len(c.Hurricane.Rules) > 0},
+	} {
+		if d.on {
+			enabled = append(enabled, d.name)
+		}
+	}
+	return enabled
+}
+
+// FromFile sets Config c based on the file contents
+func (c *Config) FromFile(fname string) error {
+	var (
+		file, uclJSON []byte
+		err           error
+		uclData       map[string]interface{}
+	)
+	if fname, err = filepath.Abs(fname); err != nil {
+		return err
+	}
+	if fname, err = filepath.EvalSymlinks(fname); err != nil {
+		return err
+	}
+	if file, err = ioutil.ReadFile(fname); err != nil {
+		return err
+	}
+
+	parser := ucl.NewParser(bytes.NewBuffer(file))
+	if uclData, err = parser.Ucl(); err != nil {
+		return err
+	}
+
+	// take the detour via JSON to load UCL into the struct
+	if uclJSON, err = json.Marshal(uclData); err != nil {
+		return err
+	}
+	return json.Unmarshal(uclJSON, c)
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -8,20 +8,46 @@
 
 // Package cpu provides the following derived metrics:
 //	- cpu.usage.percent
+//	- cpu.user.percent
+//	- cpu.system.percent
+//	- cpu.iowait.percent
+//	- cpu.irq.percent
+//	- cpu.softirq.percent
+//	- cpu.nice.percent
+//	- cpu.idle.percent
+//	- cpu.steal.percent
+//	- cpu.guest.percent
+//	- cpu.core.count
+//
+// The steal, guest and guest_nice counters are optional. Once they
+// have been seen for a core, they are required for its counters to be
+// complete. cpu.steal.percent and cpu.guest.percent are only derived
+// for cores that report them. Steal time counts as usage, guest time
+// is already included in user and nice time.
+//
+// The metrics are derived from the aggregate counters tagged cpu.
+// Except for cpu.core.count, they are also derived per core from the
+// counters tagged cpuN and suffixed with :cpuN.
 package cpu // import "github.com/solnx/hurricane/internal/cpu"
 
 import (
 	"math"
+	"strings"
 	"time"
 
 	"github.com/mjolnir42/erebos"
-	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/numeric"
+	"github.com/solnx/hurricane/internal/reorder"
 	"github.com/solnx/legacy"
 )
 
 // CPU implements the logic to compute derived cpu usage metrics
 type CPU struct {
 	assetID  int64
+	core     string
+	cores    func(since time.Time) int
+	optional optional
 	curr     distribution
 	next     distribution
 	currTime time.Time
@@ -30,12 +56,18 @@ type CPU struct {
 	nonIdle  int64
 	total    int64
 	usage    float64
-	lookup   *wall.Lookup
+	lookup   intf.TagLookup
 	ack      []*erebos.Transport
+	pending  []intf.Offset
+	lastSeen time.Time
+	buffer   *reorder.Buffer
 }
 
 // Update adds m to the next counter tracked by c
 func (c *CPU) update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	// track activity for the eviction of idle state
+	c.lastSeen = time.Now()
+
 	// set assetID on first use
 	if c.assetID == 0 {
 		c.assetID = m.AssetID
@@ -47,63 +79,116 @@ func (c *CPU) update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.Metr
 		return []*legacy.MetricSplit{}, []*erebos.Transport{t}, true, nil
 	}
 
-	// only process metrics tagged as cpu, not cpuN
-	cpuMetric := false
-	for _, tag := range m.Tags {
-		if tag == `cpu` {
-			cpuMetric = true
-			break
-		}
-	}
-	if !cpuMetric {
+	// check update is for the core tracked by c
+	if core, ok := coreTag(m); !ok || core != c.core {
+		// send back t so the offset gets committed
 		return []*legacy.MetricSplit{}, []*erebos.Transport{t}, true, nil
 	}
 
-processing:
-	if c.nextTime.IsZero() {
-		c.nextTime = m.TS
+	// redelivery of a message that is part of the restored state
+	pending, claimed := intf.Claim(c.pending, t)
+	c.pending = pending
+	if claimed {
+		c.ack = append(c.ack, t)
+		return nil, nil, false, nil
+	}
+
+	value, err := numeric.Int64(m)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	// optional counters are required once a valid value has been seen
+	switch m.Path {
+	case `/sys/cpu/count/steal`:
+		c.optional.steal = true
+	case `/sys/cpu/count/guest`:
+		c.optional.guest = true
+	case `/sys/cpu/count/guest_nice`:
+		c.optional.guestNice = true
 	}
 
-	// out of order metric for old timestamp
-	if c.nextTime.After(m.TS) {
+	// metric for a measurement cycle that was already evaluated
+	if !c.currTime.IsZero() && !m.TS.After(c.currTime) {
 		return []*legacy.MetricSplit{}, []*erebos.Transport{t}, true, nil
 	}
 
-	// abandon current next and start new one
-	if c.nextTime.Before(m.TS) {
-		c.nextTime = time.Time{}
-		c.next = distribution{}
-		goto processing
-	}
-
-	if c.nextTime.Equal(m.TS) {
-		switch m.Path {
-		case `/sys/cpu/count/idle`:
-			c.next.idle = m.Value().(int64)
-			c.next.setIdle = true
-		case `/sys/cpu/count/iowait`:
-			c.next.ioWait = m.Value().(int64)
-			c.next.setIoWait = true
-		case `/sys/cpu/count/irq`:
-			c.next.irq = m.Value().(int64)
-			c.next.setIrq = true
-		case `/sys/cpu/count/nice`:
-			c.next.nice = m.Value().(int64)
-			c.next.setNice = true
-		case `/sys/cpu/count/softirq`:
-			c.next.softIrq = m.Value().(int64)
-			c.next.setSoftIrq = true
-		case `/sys/cpu/count/system`:
-			c.next.system = m.Value().(int64)
-			c.next.setSystem = true
-		case `/sys/cpu/count/user`:
-			c.next.user = m.Value().(int64)
-			c.next.setUser = true
-		}
+	e := c.buffer.Get(m.TS, func() interface{} {
+		return &distribution{}
+	})
+	next := e.Value.(*distribution)
+	switch m.Path {
+	case `/sys/cpu/count/idle`:
+		next.idle = value
+		next.setIdle = true
+	case `/sys/cpu/count/iowait`:
+		next.ioWait = value
+		next.setIoWait = true
+	case `/sys/cpu/count/irq`:
+		next.irq = value
+		next.setIrq = true
+	case `/sys/cpu/count/nice`:
+		next.nice = value
+		next.setNice = true
+	case `/sys/cpu/count/softirq`:
+		next.softIrq = value
+		next.setSoftIrq = true
+	case `/sys/cpu/count/system`:
+		next.system = value
+		next.setSystem = true
+	case `/sys/cpu/count/user`:
+		next.user = value
+		next.setUser = true
+	case `/sys/cpu/count/steal`:
+		next.steal = value
+		next.setSteal = true
+	case `/sys/cpu/count/guest`:
+		next.guest = value
+		next.setGuest = true
+	case `/sys/cpu/count/guest_nice`:
+		next.guestNice = value
+		next.setGuestNice = true
 	}
+	e.Acks = append(e.Acks, t)
+
+	// counters that fell out of the reorder window are abandoned
+	abandoned := c.buffer.Trim()
+
+	derived, acks, ok, err := c.evaluate()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if len(abandoned) > 0 {
+		return derived, append(acks, abandoned...), true, nil
+	}
+	return derived, acks, ok, nil
+}
+
+// evaluate calculates the derived metrics for all complete counters at
+// the start of the reorder buffer in timestamp order. Evaluation stops
+// at the first incomplete counter.
+func (c *CPU) evaluate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var ok bool
 
-	c.ack = append(c.ack, t)
-	return c.calculate()
+	for e := c.buffer.Oldest(); e != nil && e.Value.(*distribution).valid(c.optional); e = c.buffer.Oldest() {
+		c.buffer.Pop()
+		c.next = *e.Value.(*distribution)
+		c.nextTime = e.TS
+		c.ack = append(c.ack, e.Acks...)
+
+		m, a, done, err := c.calculate()
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if done {
+			derived = append(derived, m...)
+			acks = append(acks, a...)
+			ok = true
+		}
+	}
+	return derived, acks, ok, nil
 }
 
 // calculate checks if the next counter has been fully assembled and
@@ -112,7 +197,7 @@ processing:
 // it returns nil.
 func (c *CPU) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
 
-	if c.nextTime.IsZero() || !c.next.valid() {
+	if c.nextTime.IsZero() || !c.next.valid(c.optional) {
 		return nil, nil, false, nil
 	}
 
@@ -137,15 +222,21 @@ func (c *CPU) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, err
 
 	totalDifference := (nextIdle + nextNonIdle) - c.total
 	idleDifference := nextIdle - c.idle
+	// steal time is only accounted once both counters include it
+	if c.curr.setSteal && c.next.setSteal {
+		totalDifference += c.next.steal - c.curr.steal
+	}
 	c.usage = float64((totalDifference - idleDifference)) / float64(totalDifference)
 	c.usage = round(c.usage, .5, 4) * 100
+	modes := c.modes()
 
 	c.idle = nextIdle
 	c.nonIdle = nextNonIdle
 	c.total = nextIdle + nextNonIdle
 
+	since := c.currTime
 	c.nextToCurrent()
-	derived, err := c.emitMetric()
+	derived, err := c.emitMetric(modes, since)
 	if err != nil {
 		return nil, nil, false, err
 	}
@@ -154,6 +245,72 @@ func (c *CPU) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, err
 	return derived, acks, true, nil
 }
 
+// expire gives up on all counters in the reorder buffer that were
+// started before deadline and are still incomplete. If partial is
+// set, missing values are carried over from the current counter and
+// the result is evaluated. Otherwise, or if the result can still not
+// be evaluated, the counter is dropped and its acknowledgements are
+// released. Complete counters that were waiting for the expired ones
+// are evaluated afterwards. It returns the number of dropped and
+// partially evaluated counters.
+func (c *CPU) expire(deadline time.Time, partial bool) ([]*legacy.MetricSplit, []*erebos.Transport, int, int, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var dropped, evaluated int
+
+	for e := c.buffer.Oldest(); e != nil && e.Start.Before(deadline); e = c.buffer.Oldest() {
+		c.buffer.Pop()
+		next := e.Value.(*distribution)
+		if !next.valid(c.optional) && partial && !c.currTime.IsZero() {
+			next.fill(&c.curr)
+			if next.valid(c.optional) {
+				evaluated++
+			}
+		}
+		if !next.valid(c.optional) {
+			acks = append(acks, e.Acks...)
+			dropped++
+			continue
+		}
+
+		c.next = *next
+		c.nextTime = e.TS
+		c.ack = append(c.ack, e.Acks...)
+		m, a, ok, err := c.calculate()
+		if err != nil {
+			return nil, nil, 0, 0, err
+		}
+		if ok {
+			derived = append(derived, m...)
+			acks = append(acks, a...)
+		}
+	}
+
+	m, a, _, err := c.evaluate()
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	derived = append(derived, m...)
+	acks = append(acks, a...)
+	return derived, acks, dropped, evaluated, nil
+}
+
+// outstanding returns all acknowledgements held by c
+func (c *CPU) outstanding() []*erebos.Transport {
+	return append(c.buffer.Acks(), c.ack...)
+}
+
+// lastCounter returns the time of the newest counter c has received
+func (c *CPU) lastCounter() time.Time {
+	last := c.currTime
+	if entries := c.buffer.Entries(); len(entries) > 0 {
+		if ts := entries[len(entries)-1].TS; ts.After(last) {
+			last = ts
+		}
+	}
+	return last
+}
+
 // nextToCurrent advances the counters within c by one step
 func (c *CPU) nextToCurrent() {
 	c.currTime = c.nextTime
@@ -163,11 +320,70 @@ func (c *CPU) nextToCurrent() {
 	c.next = distribution{}
 }
 
-// emitMetric returns the derived metrics for the current counter
-func (c *CPU) emitMetric() ([]*legacy.MetricSplit, error) {
+// mode is the share of a cpu mode in the time spent between two
+// counters
+type mode struct {
+	name    string
+	percent float64
+}
+
+// modes returns the share of every cpu mode in the time spent between
+// the current and the next counter. It returns nil if no time was
+// spent.
+func (c *CPU) modes() []mode {
+	spent := []mode{
+		{`user`, float64(c.next.user - c.curr.user)},
+		{`system`, float64(c.next.system - c.curr.system)},
+		{`iowait`, float64(c.next.ioWait - c.curr.ioWait)},
+		{`irq`, float64(c.next.irq - c.curr.irq)},
+		{`softirq`, float64(c.next.softIrq - c.curr.softIrq)},
+		{`nice`, float64(c.next.nice - c.curr.nice)},
+		{`idle`, float64(c.next.idle - c.curr.idle)},
+	}
+	if c.curr.setSteal && c.next.setSteal {
+		spent = append(spent, mode{
+			`steal`, float64(c.next.steal - c.curr.steal),
+		})
+	}
+	var total float64
+	for i := range spent {
+		total += spent[i].percent
+	}
+	if total <= 0 {
+		return nil
+	}
+	for i := range spent {
+		spent[i].percent = round(spent[i].percent/total*100, .5, 2)
+	}
+
+	// guest time is already accounted as user and nice time
+	if c.curr.setGuest && c.next.setGuest {
+		guest := float64(c.next.guest - c.curr.guest)
+		if c.curr.setGuestNice && c.next.setGuestNice {
+			guest += float64(c.next.guestNice - c.curr.guestNice)
+		}
+		spent = append(spent, mode{
+			`guest`, round(guest/total*100, .5, 2),
+		})
+	}
+	return spent
+}
+
+// path returns the path of the derived metric name for the core
+// tracked by c
+func (c *CPU) path(name string) string {
+	if c.core == `cpu` {
+		return name
+	}
+	return name + `:` + c.core
+}
+
+// emitMetric returns the derived metrics for the current counter,
+// with since being the time of the previous counter
+func (c *CPU) emitMetric(modes []mode, since time.Time) ([]*legacy.MetricSplit, error) {
 	cup := &legacy.MetricSplit{
 		AssetID: c.assetID,
-		Path:    `cpu.usage.percent`,
+		Path:    c.path(`cpu.usage.percent`),
 		TS:      c.currTime,
 		Type:    `real`,
 		Unit:    `%`,
@@ -175,39 +391,131 @@ func (c *CPU) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: c.usage,
 		},
 	}
-	if tags, err := c.lookup.GetConfigurationID(
-		cup.LookupID(),
-	); err == nil {
-		cup.Tags = tags
-	} else if err != wall.ErrUnconfigured {
+
+	result := []*legacy.MetricSplit{cup}
+	for i := range modes {
+		result = append(result, &legacy.MetricSplit{
+			AssetID: c.assetID,
+			Path:    c.path(`cpu.` + modes[i].name + `.percent`),
+			TS:      c.currTime,
+			Type:    `real`,
+			Unit:    `%`,
+			Val: legacy.MetricValue{
+				FlpVal: modes[i].percent,
+			},
+		})
+	}
+	if c.cores != nil {
+		if cores := c.cores(since); cores > 0 {
+			result = append(result, &legacy.MetricSplit{
+				AssetID: c.assetID,
+				Path:    `cpu.core.count`,
+				TS:      c.currTime,
+				Type:    `integer`,
+				Unit:    `#`,
+				Val: legacy.MetricValue{
+					IntVal: int64(cores),
+				},
+			})
+		}
+	}
+
+	if err := intf.LookupTags(c.lookup, result); err != nil {
+		// do not emit potentially incorrect metrics
 		return []*legacy.MetricSplit{}, err
 	}
-	return []*legacy.MetricSplit{cup}, nil
+	return result, nil
+}
+
+// coreTag returns the tag of m that names the core of its counter,
+// either cpu for the aggregate counters or cpuN for a single core. It
+// returns false if m has neither.
+func coreTag(m *legacy.MetricSplit) (string, bool) {
+	for _, tag := range m.Tags {
+		if tag == `cpu` {
+			return tag, true
+		}
+		if len(tag) > 3 && strings.HasPrefix(tag, `cpu`) &&
+			strings.Trim(tag[3:], `0123456789`) == `` {
+			return tag, true
+		}
+	}
+	return ``, false
+}
+
+// optional records which optional counters are reported for a core
+type optional struct {
+	steal     bool
+	guest     bool
+	guestNice bool
 }
 
 // distribution is used to track multiple cpu metrics from the same
 // measurement cycle
 type distribution struct {
-	setIdle    bool
-	setIoWait  bool
-	setIrq     bool
-	setNice    bool
-	setSoftIrq bool
-	setSystem  bool
-	setUser    bool
-	idle       int64
-	ioWait     int64
-	irq        int64
-	nice       int64
-	softIrq    int64
-	system     int64
-	user       int64
-}
-
-// valid checks if a counter has been fully populated
-func (d *distribution) valid() bool {
+	setIdle      bool
+	setIoWait    bool
+	setIrq       bool
+	setNice      bool
+	setSoftIrq   bool
+	setSystem    bool
+	setUser      bool
+	setSteal     bool
+	setGuest     bool
+	setGuestNice bool
+	idle         int64
+	ioWait       int64
+	irq          int64
+	nice         int64
+	softIrq      int64
+	system       int64
+	user         int64
+	steal        int64
+	guest        int64
+	guestNice    int64
+}
+
+// valid checks if a counter has been fully populated, including the
+// optional counters reported for the core
+func (d *distribution) valid(o optional) bool {
 	return d.setIdle && d.setIoWait && d.setIrq && d.setNice &&
-		d.setSoftIrq && d.setSystem && d.setUser
+		d.setSoftIrq && d.setSystem && d.setUser &&
+		(d.setSteal || !o.steal) && (d.setGuest || !o.guest) &&
+		(d.setGuestNice || !o.guestNice)
+}
+
+// fill copies the values that are missing in d from prev
+func (d *distribution) fill(prev *distribution) {
+	if !d.setIdle && prev.setIdle {
+		d.idle, d.setIdle = prev.idle, true
+	}
+	if !d.setIoWait && prev.setIoWait {
+		d.ioWait, d.setIoWait = prev.ioWait, true
+	}
+	if !d.setIrq && prev.setIrq {
+		d.irq, d.setIrq = prev.irq, true
+	}
+	if !d.setNice && prev.setNice {
+		d.nice, d.setNice = prev.nice, true
+	}
+	if !d.setSoftIrq && prev.setSoftIrq {
+		d.softIrq, d.setSoftIrq = prev.softIrq, true
+	}
+	if !d.setSystem && prev.setSystem {
+		d.system, d.setSystem = prev.system, true
+	}
+	if !d.setUser && prev.setUser {
+		d.user, d.setUser = prev.user, true
+	}
+	if !d.setSteal && prev.setSteal {
+		d.steal, d.setSteal = prev.steal, true
+	}
+	if !d.setGuest && prev.setGuest {
+		d.guest, d.setGuest = prev.guest, true
+	}
+	if !d.setGuestNice && prev.setGuestNice {
+		d.guestNice, d.setGuestNice = prev.guestNice, true
+	}
 }
 
 // https://gist.github.com/DavidVaini/10308388
@@ -9,26 +9,41 @@
 package cpu // import "github.com/solnx/hurricane/internal/cpu"
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/mjolnir42/erebos"
-	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/hurricane/internal/config"
 	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/registry"
+	"github.com/solnx/hurricane/internal/reorder"
 	"github.com/solnx/legacy"
 )
 
 // Implementation of the intf.Deriver interface
 
+func init() {
+	registry.Register(`cpu`, func(conf *erebos.Config, settings *config.Config, lookup intf.TagLookup) (intf.Deriver, error) {
+		return NewDeriver(lookup, settings.Deriver(`cpu`)), nil
+	})
+}
+
 // NewDeriver ...
-func NewDeriver(conf *erebos.Config) *Deriver {
+func NewDeriver(lookup intf.TagLookup, settings config.Deriver) *Deriver {
 	d := &Deriver{}
-	d.data = make(map[int64]*CPU)
-	d.lookup = wall.NewLookup(conf, `hurricane`)
+	d.data = make(map[int64]map[string]*CPU)
+	d.lookup = lookup
+	d.window = time.Duration(settings.ReorderWindow) * time.Second
+	d.cycles = settings.ReorderCycles
 	return d
 }
 
 // Deriver ...
 type Deriver struct {
-	data   map[int64]*CPU
-	lookup *wall.Lookup
+	data   map[int64]map[string]*CPU
+	lookup intf.TagLookup
+	window time.Duration
+	cycles int
 }
 
 // Start ...
@@ -51,6 +66,9 @@ func (d *Deriver) Register(m map[string]intf.Deriver) {
 		`/sys/cpu/count/softirq`,
 		`/sys/cpu/count/system`,
 		`/sys/cpu/count/user`,
+		`/sys/cpu/count/steal`,
+		`/sys/cpu/count/guest`,
+		`/sys/cpu/count/guest_nice`,
 	} {
 		m[s] = d
 	}
@@ -58,13 +76,124 @@ func (d *Deriver) Register(m map[string]intf.Deriver) {
 
 // Update ...
 func (d *Deriver) Update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	core, ok := coreTag(m)
+	if !ok {
+		// valid cpu metrics require the cpu or cpuN tag
+		return []*legacy.MetricSplit{}, []*erebos.Transport{t}, true, nil
+	}
+
 	if _, ok := d.data[m.AssetID]; !ok {
-		d.data[m.AssetID] = &CPU{
-			lookup: d.lookup,
+		d.data[m.AssetID] = make(map[string]*CPU)
+	}
+
+	if _, ok := d.data[m.AssetID][core]; !ok {
+		d.data[m.AssetID][core] = d.newCPU(m.AssetID, core)
+	}
+
+	return d.data[m.AssetID][core].update(m, t)
+}
+
+// newCPU returns a new CPU for core of assetID
+func (d *Deriver) newCPU(assetID int64, core string) *CPU {
+	c := &CPU{
+		core:   core,
+		lookup: d.lookup,
+		buffer: reorder.New(d.window, d.cycles),
+	}
+	if core == `cpu` {
+		// cores of the asset that reported counters since the
+		// previous aggregate counter. Cores that went offline stop
+		// being counted once they missed a measurement cycle.
+		c.cores = func(since time.Time) int {
+			var cores int
+			for name, core := range d.data[assetID] {
+				if name != `cpu` && !core.lastCounter().Before(since) {
+					cores++
+				}
+			}
+			return cores
+		}
+	}
+	return c
+}
+
+// Snapshot ...
+func (d *Deriver) Snapshot() ([]byte, error) {
+	s := make(map[int64]map[string]state, len(d.data))
+	for assetID := range d.data {
+		s[assetID] = make(map[string]state, len(d.data[assetID]))
+		for core := range d.data[assetID] {
+			s[assetID][core] = d.data[assetID][core].export()
 		}
 	}
+	return json.Marshal(s)
+}
 
-	return d.data[m.AssetID].update(m, t)
+// Restore ...
+func (d *Deriver) Restore(b []byte) error {
+	s := make(map[int64]map[string]state)
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	for assetID := range s {
+		if _, ok := d.data[assetID]; !ok {
+			d.data[assetID] = make(map[string]*CPU)
+		}
+		for core := range s[assetID] {
+			d.data[assetID][core] = d.newCPU(assetID, core)
+			d.data[assetID][core].load(s[assetID][core])
+		}
+	}
+	return nil
+}
+
+// Evict ...
+func (d *Deriver) Evict(deadline time.Time) ([]*erebos.Transport, int) {
+	acks := []*erebos.Transport{}
+	var evicted int
+	for assetID := range d.data {
+		for core := range d.data[assetID] {
+			if d.data[assetID][core].lastSeen.Before(deadline) {
+				acks = append(acks, d.data[assetID][core].outstanding()...)
+				delete(d.data[assetID], core)
+				evicted++
+			}
+		}
+		if len(d.data[assetID]) == 0 {
+			delete(d.data, assetID)
+		}
+	}
+	return acks, evicted
+}
+
+// Drop ...
+func (d *Deriver) Drop(assetID int64) []*erebos.Transport {
+	acks := []*erebos.Transport{}
+	for core := range d.data[assetID] {
+		acks = append(acks, d.data[assetID][core].outstanding()...)
+	}
+	delete(d.data, assetID)
+	return acks
+}
+
+// Expire ...
+func (d *Deriver) Expire(deadline time.Time, partial bool) ([]*legacy.MetricSplit, []*erebos.Transport, int, int, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var dropped, evaluated int
+	for assetID := range d.data {
+		for core := range d.data[assetID] {
+			m, a, drp, evl, err := d.data[assetID][core].expire(deadline, partial)
+			if err != nil {
+				return nil, nil, 0, 0, err
+			}
+			derived = append(derived, m...)
+			acks = append(acks, a...)
+			dropped += drp
+			evaluated += evl
+		}
+	}
+	return derived, acks, dropped, evaluated, nil
 }
 
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
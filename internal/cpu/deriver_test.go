@@ -0,0 +1,27 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cpu // import "github.com/solnx/hurricane/internal/cpu"
+
+import (
+	"testing"
+
+	"github.com/solnx/hurricane/internal/config"
+	"github.com/solnx/hurricane/internal/derivertest"
+	"github.com/solnx/hurricane/internal/intf"
+)
+
+func TestGolden(t *testing.T) {
+	derivertest.Suite(t, `testdata`, func(lookup intf.TagLookup) intf.Deriver {
+		return NewDeriver(lookup, config.Deriver{
+			ReorderCycles: 2,
+		})
+	})
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,176 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package cpu // import "github.com/solnx/hurricane/internal/cpu"
+
+import (
+	"time"
+
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/reorder"
+)
+
+// state is the serializable form of CPU
+type state struct {
+	AssetID  int64             `json:"asset.id"`
+	Curr     distributionState `json:"curr"`
+	CurrTime time.Time         `json:"curr.time"`
+	Buffer   []cycleState      `json:"buffer"`
+	Idle     int64             `json:"idle"`
+	NonIdle  int64             `json:"non.idle"`
+	Total    int64             `json:"total"`
+	Usage    float64           `json:"usage"`
+	Optional optionalState     `json:"optional"`
+	Ack      []intf.Offset     `json:"ack"`
+}
+
+// optionalState is the serializable form of optional
+type optionalState struct {
+	Steal     bool `json:"steal"`
+	Guest     bool `json:"guest"`
+	GuestNice bool `json:"guest.nice"`
+}
+
+// cycleState is the serializable form of a reorder buffer entry
+type cycleState struct {
+	TS   time.Time         `json:"ts"`
+	Next distributionState `json:"next"`
+}
+
+// distributionState is the serializable form of distribution
+type distributionState struct {
+	SetIdle      bool  `json:"set.idle"`
+	SetIoWait    bool  `json:"set.iowait"`
+	SetIrq       bool  `json:"set.irq"`
+	SetNice      bool  `json:"set.nice"`
+	SetSoftIrq   bool  `json:"set.softirq"`
+	SetSystem    bool  `json:"set.system"`
+	SetUser      bool  `json:"set.user"`
+	SetSteal     bool  `json:"set.steal"`
+	SetGuest     bool  `json:"set.guest"`
+	SetGuestNice bool  `json:"set.guest.nice"`
+	Idle         int64 `json:"idle"`
+	IoWait       int64 `json:"iowait"`
+	Irq          int64 `json:"irq"`
+	Nice         int64 `json:"nice"`
+	SoftIrq      int64 `json:"softirq"`
+	System       int64 `json:"system"`
+	User         int64 `json:"user"`
+	Steal        int64 `json:"steal"`
+	Guest        int64 `json:"guest"`
+	GuestNice    int64 `json:"guest.nice"`
+}
+
+// export returns the serializable state of c. Outstanding
+// acknowledgements are exported as offsets.
+func (c *CPU) export() state {
+	s := state{
+		AssetID:  c.assetID,
+		Curr:     c.curr.export(),
+		CurrTime: c.currTime,
+		Buffer:   []cycleState{},
+		Idle:     c.idle,
+		NonIdle:  c.nonIdle,
+		Total:    c.total,
+		Usage:    c.usage,
+		Optional: optionalState{
+			Steal:     c.optional.steal,
+			Guest:     c.optional.guest,
+			GuestNice: c.optional.guestNice,
+		},
+		Ack: append(intf.Offsets(c.outstanding()), c.pending...),
+	}
+	for _, e := range c.buffer.Entries() {
+		s.Buffer = append(s.Buffer, cycleState{
+			TS:   e.TS,
+			Next: e.Value.(*distribution).export(),
+		})
+	}
+	return s
+}
+
+// load sets c to the state s. The acknowledgements in s are stored
+// as pending until their messages are redelivered.
+func (c *CPU) load(s state) {
+	c.assetID = s.AssetID
+	c.curr = s.Curr.load()
+	c.currTime = s.CurrTime
+	for i := range s.Buffer {
+		next := s.Buffer[i].Next.load()
+		c.buffer.Insert(&reorder.Entry{
+			TS:    s.Buffer[i].TS,
+			Start: time.Now(),
+			Value: &next,
+		})
+	}
+	c.idle = s.Idle
+	c.nonIdle = s.NonIdle
+	c.total = s.Total
+	c.usage = s.Usage
+	c.optional = optional{
+		steal:     s.Optional.Steal,
+		guest:     s.Optional.Guest,
+		guestNice: s.Optional.GuestNice,
+	}
+	c.pending = s.Ack
+	c.lastSeen = time.Now()
+}
+
+// export returns the serializable state of d
+func (d *distribution) export() distributionState {
+	return distributionState{
+		SetIdle:      d.setIdle,
+		SetIoWait:    d.setIoWait,
+		SetIrq:       d.setIrq,
+		SetNice:      d.setNice,
+		SetSoftIrq:   d.setSoftIrq,
+		SetSystem:    d.setSystem,
+		SetUser:      d.setUser,
+		SetSteal:     d.setSteal,
+		SetGuest:     d.setGuest,
+		SetGuestNice: d.setGuestNice,
+		Idle:         d.idle,
+		IoWait:       d.ioWait,
+		Irq:          d.irq,
+		Nice:         d.nice,
+		SoftIrq:      d.softIrq,
+		System:       d.system,
+		User:         d.user,
+		Steal:        d.steal,
+		Guest:        d.guest,
+		GuestNice:    d.guestNice,
+	}
+}
+
+// load returns the distribution described by s
+func (s distributionState) load() distribution {
+	return distribution{
+		setIdle:      s.SetIdle,
+		setIoWait:    s.SetIoWait,
+		setIrq:       s.SetIrq,
+		setNice:      s.SetNice,
+		setSoftIrq:   s.SetSoftIrq,
+		setSystem:    s.SetSystem,
+		setUser:      s.SetUser,
+		setSteal:     s.SetSteal,
+		setGuest:     s.SetGuest,
+		setGuestNice: s.SetGuestNice,
+		idle:         s.Idle,
+		ioWait:       s.IoWait,
+		irq:          s.Irq,
+		nice:         s.Nice,
+		softIrq:      s.SoftIrq,
+		system:       s.System,
+		user:         s.User,
+		steal:        s.Steal,
+		guest:        s.Guest,
+		guestNice:    s.GuestNice,
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
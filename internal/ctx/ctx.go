@@ -15,7 +15,8 @@ import (
 	"time"
 
 	"github.com/mjolnir42/erebos"
-	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/numeric"
 	"github.com/solnx/legacy"
 )
 
@@ -27,14 +28,19 @@ type CTX struct {
 	cps       float64
 	currTime  time.Time
 	nextTime  time.Time
-	lookup    *wall.Lookup
+	lookup    intf.TagLookup
 	ack       []*erebos.Transport
+	pending   []intf.Offset
+	lastSeen  time.Time
 }
 
 // Update adds m to the next counter tracked by c and returns the
 // derived metric if there is a new derived metric to be computed.
 // Otherwise it returns nil.
 func (c *CTX) update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	// track activity for the eviction of idle state
+	c.lastSeen = time.Now()
+
 	// set assetID on first use
 	if c.assetID == 0 {
 		c.assetID = m.AssetID
@@ -46,10 +52,23 @@ func (c *CTX) update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.Metr
 		return []*legacy.MetricSplit{}, []*erebos.Transport{t}, true, nil
 	}
 
+	// redelivery of a message that is part of the restored state
+	pending, claimed := intf.Claim(c.pending, t)
+	c.pending = pending
+	if claimed {
+		c.ack = append(c.ack, t)
+		return nil, nil, false, nil
+	}
+
+	value, err := numeric.Int64(m)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
 	// first use, store values and transport
 	if c.currTime.IsZero() {
 		c.currTime = m.TS
-		c.currValue = m.Value().(int64)
+		c.currValue = value
 		c.ack = []*erebos.Transport{t}
 		return nil, nil, false, nil
 	}
@@ -60,7 +79,7 @@ func (c *CTX) update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.Metr
 	}
 
 	c.nextTime = m.TS
-	c.nextValue = m.Value().(int64)
+	c.nextValue = value
 	c.ack = append(c.ack, t)
 	return c.calculate()
 }
@@ -105,15 +124,13 @@ func (c *CTX) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: c.cps,
 		},
 	}
-	if tags, err := c.lookup.GetConfigurationID(
-		cps.LookupID(),
-	); err == nil {
-		cps.Tags = tags
-	} else if err != wall.ErrUnconfigured {
+
+	result := []*legacy.MetricSplit{cps}
+	if err := intf.LookupTags(c.lookup, result); err != nil {
+		// do not emit potentially incorrect metrics
 		return []*legacy.MetricSplit{}, err
 	}
-
-	return []*legacy.MetricSplit{cps}, nil
+	return result, nil
 }
 
 // https://gist.github.com/DavidVaini/10308388
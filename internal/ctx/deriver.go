@@ -9,26 +9,36 @@
 package ctx // import "github.com/solnx/hurricane/internal/ctx"
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/mjolnir42/erebos"
-	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/hurricane/internal/config"
 	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/registry"
 	"github.com/solnx/legacy"
 )
 
 // Implementation of the intf.Deriver interface
 
+func init() {
+	registry.Register(`ctx`, func(conf *erebos.Config, settings *config.Config, lookup intf.TagLookup) (intf.Deriver, error) {
+		return NewDeriver(lookup), nil
+	})
+}
+
 // NewDeriver ...
-func NewDeriver(conf *erebos.Config) *Deriver {
+func NewDeriver(lookup intf.TagLookup) *Deriver {
 	d := &Deriver{}
 	d.Data = make(map[int64]*CTX)
-	d.lookup = wall.NewLookup(conf, `hurricane`)
+	d.lookup = lookup
 	return d
 }
 
 // Deriver ...
 type Deriver struct {
 	Data   map[int64]*CTX
-	lookup *wall.Lookup
+	lookup intf.TagLookup
 }
 
 // Start ...
@@ -57,4 +67,52 @@ func (d *Deriver) Update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.
 	return d.Data[m.AssetID].update(m, t)
 }
 
+// Snapshot ...
+func (d *Deriver) Snapshot() ([]byte, error) {
+	s := make(map[int64]state, len(d.Data))
+	for assetID := range d.Data {
+		s[assetID] = d.Data[assetID].export()
+	}
+	return json.Marshal(s)
+}
+
+// Restore ...
+func (d *Deriver) Restore(b []byte) error {
+	s := make(map[int64]state)
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	for assetID := range s {
+		d.Data[assetID] = &CTX{
+			lookup: d.lookup,
+		}
+		d.Data[assetID].load(s[assetID])
+	}
+	return nil
+}
+
+// Evict ...
+func (d *Deriver) Evict(deadline time.Time) ([]*erebos.Transport, int) {
+	acks := []*erebos.Transport{}
+	var evicted int
+	for assetID := range d.Data {
+		if d.Data[assetID].lastSeen.Before(deadline) {
+			acks = append(acks, d.Data[assetID].ack...)
+			delete(d.Data, assetID)
+			evicted++
+		}
+	}
+	return acks, evicted
+}
+
+// Drop ...
+func (d *Deriver) Drop(assetID int64) []*erebos.Transport {
+	acks := []*erebos.Transport{}
+	if _, ok := d.Data[assetID]; ok {
+		acks = append(acks, d.Data[assetID].ack...)
+		delete(d.Data, assetID)
+	}
+	return acks
+}
+
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,80 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package ctx // import "github.com/solnx/hurricane/internal/ctx"
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/hurricane/internal/derivertest"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/lookup"
+	"github.com/solnx/legacy"
+)
+
+func TestGolden(t *testing.T) {
+	derivertest.Suite(t, `testdata`, func(lookup intf.TagLookup) intf.Deriver {
+		return NewDeriver(lookup)
+	})
+}
+
+// TestRestorePending drops a restored acknowledgement once a later
+// message of its partition is delivered, its message was committed
+// before the restart and is never redelivered
+func TestRestorePending(t *testing.T) {
+	update := func(d *Deriver, offset int64, min int, v int64) {
+		m := &legacy.MetricSplit{
+			AssetID: 1,
+			Path:    `/sys/cpu/ctx`,
+			TS:      time.Date(2017, 6, 1, 10, min, 0, 0, time.UTC),
+			Type:    `integer`,
+			Val:     legacy.MetricValue{IntVal: v},
+		}
+		if _, _, _, err := d.Update(m, &erebos.Transport{
+			Topic:  `metrics`,
+			Offset: offset,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pending := func(d *Deriver) []intf.Offset {
+		b, err := d.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := map[int64]state{}
+		if err = json.Unmarshal(b, &s); err != nil {
+			t.Fatal(err)
+		}
+		return s[1].Ack
+	}
+
+	d := NewDeriver(lookup.NewMemory())
+	update(d, 0, 0, 100000)
+	b, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d = NewDeriver(lookup.NewMemory())
+	if err = d.Restore(b); err != nil {
+		t.Fatal(err)
+	}
+	if acks := pending(d); len(acks) != 1 || acks[0].Offset != 0 {
+		t.Fatalf("restored acknowledgements %v, expected offset 0", acks)
+	}
+	update(d, 5, 1, 160000)
+	if acks := pending(d); len(acks) != 0 {
+		t.Errorf("acknowledgements %v still pending", acks)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,55 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package ctx // import "github.com/solnx/hurricane/internal/ctx"
+
+import (
+	"time"
+
+	"github.com/solnx/hurricane/internal/intf"
+)
+
+// state is the serializable form of CTX
+type state struct {
+	AssetID   int64         `json:"asset.id"`
+	CurrValue int64         `json:"curr.value"`
+	NextValue int64         `json:"next.value"`
+	CPS       float64       `json:"cps"`
+	CurrTime  time.Time     `json:"curr.time"`
+	NextTime  time.Time     `json:"next.time"`
+	Ack       []intf.Offset `json:"ack"`
+}
+
+// export returns the serializable state of c. Outstanding
+// acknowledgements are exported as offsets.
+func (c *CTX) export() state {
+	return state{
+		AssetID:   c.assetID,
+		CurrValue: c.currValue,
+		NextValue: c.nextValue,
+		CPS:       c.cps,
+		CurrTime:  c.currTime,
+		NextTime:  c.nextTime,
+		Ack:       append(intf.Offsets(c.ack), c.pending...),
+	}
+}
+
+// load sets c to the state s. The acknowledgements in s are stored
+// as pending until their messages are redelivered.
+func (c *CTX) load(s state) {
+	c.assetID = s.AssetID
+	c.currValue = s.CurrValue
+	c.nextValue = s.NextValue
+	c.cps = s.CPS
+	c.currTime = s.CurrTime
+	c.nextTime = s.NextTime
+	c.pending = s.Ack
+	c.lastSeen = time.Now()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,90 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+// Package deadletter provides the dead letter format for rejected
+// input messages and a local spool file to write them to.
+//
+// A dead letter is a JSON object carrying the original payload, the
+// reason for the rejection, the source topic, partition and offset
+// of the message and the time of the rejection. A message rejected by
+// several derivers is a single dead letter, its reason is the comma
+// separated list of their reasons. The payload is
+// stored as string, invalid UTF-8 sequences are replaced.
+package deadletter // import "github.com/solnx/hurricane/internal/deadletter"
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+)
+
+// Letter is a rejected input message
+type Letter struct {
+	Reason    string    `json:"reason"`
+	Topic     string    `json:"topic"`
+	Partition int32     `json:"partition"`
+	Offset    int64     `json:"offset"`
+	Timestamp time.Time `json:"timestamp"`
+	Payload   string    `json:"payload"`
+}
+
+// New returns the dead letter for msg, rejected for reasons
+func New(msg *erebos.Transport, reasons ...string) *Letter {
+	return &Letter{
+		Reason:    strings.Join(reasons, `,`),
+		Topic:     msg.Topic,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Timestamp: time.Now().UTC(),
+		Payload:   string(msg.Value),
+	}
+}
+
+// Spool is a local file dead letters are appended to, one JSON object
+// per line. It is safe for concurrent use.
+type Spool struct {
+	sync.Mutex
+	file *os.File
+}
+
+// OpenSpool opens the spool file at path, creating it if required
+func OpenSpool(path string) (*Spool, error) {
+	file, err := os.OpenFile(path,
+		os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return &Spool{file: file}, nil
+}
+
+// Write appends l to the spool file
+func (s *Spool) Write(l *Letter) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	s.Lock()
+	defer s.Unlock()
+	_, err = s.file.Write(data)
+	return err
+}
+
+// Close closes the spool file
+func (s *Spool) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.file.Close()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
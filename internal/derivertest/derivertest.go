@@ -0,0 +1,215 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+// Package derivertest provides a golden file test harness for
+// derivers. A recorded sequence of legacy.MetricSplit JSON lines is
+// fed through an intf.Deriver and the emitted metrics and released
+// acks are compared against a golden file.
+//
+// Input files use the extension .input and contain one metric per
+// line, in the format consumed from Kafka. Empty lines and lines
+// starting with # are ignored. The golden file for foo.input is
+// foo.golden. Run the tests with -update to rewrite the golden files.
+package derivertest // import "github.com/solnx/hurricane/internal/derivertest"
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/hurricane/internal/config"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/lookup"
+	"github.com/solnx/legacy"
+)
+
+var update = flag.Bool(`update`, false, `rewrite the golden files`)
+
+// Topic is the topic of the fake transports
+const Topic = `golden`
+
+// Factory returns the deriver under test, using lookup to tag its
+// derived metrics
+type Factory func(lookup intf.TagLookup) intf.Deriver
+
+// Suite runs every .input file in dir as a subtest against a new
+// deriver returned by f
+func Suite(t *testing.T, dir string, f Factory) {
+	inputs, err := filepath.Glob(filepath.Join(dir, `*.input`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatalf("no input files in %s", dir)
+	}
+	sort.Strings(inputs)
+
+	for _, input := range inputs {
+		input := input
+		name := strings.TrimSuffix(filepath.Base(input), `.input`)
+		t.Run(name, func(t *testing.T) {
+			Run(t, f(lookup.NewMemory()), input,
+				strings.TrimSuffix(input, `.input`)+`.golden`)
+		})
+	}
+}
+
+// Option is a deriver option and its value
+type Option struct {
+	Name  string
+	Value string
+}
+
+// InvalidRollupOptions are the values of the option rollup.exclude
+// that every deriver with a rollup rejects
+var InvalidRollupOptions = []Option{
+	{`rollup.exclude`, `[`},
+	{`rollup.exclude`, `docker*, eth[`},
+}
+
+// InvalidOptions checks that f fails to create a deriver for each of
+// options, passed as the only option of the deriver settings
+func InvalidOptions(t *testing.T, f func(settings config.Deriver) error, options []Option) {
+	for _, o := range options {
+		if err := f(config.Deriver{
+			Options: map[string]string{o.Name: o.Value},
+		}); err == nil {
+			t.Errorf("option %s: %s was accepted", o.Name, o.Value)
+		}
+	}
+}
+
+// Run feeds input through d and compares the transcript with golden
+func Run(t *testing.T, d intf.Deriver, input, golden string) {
+	got, err := Replay(d, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *update {
+		if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := ioutil.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s does not match %s\n--- got\n%s--- want\n%s",
+			input, golden, got, want)
+	}
+}
+
+// Replay feeds the metrics in input through d and returns the
+// transcript. Each metric is sent with a fake transport whose offset
+// is the number of the metric within input, starting at 0. The
+// transcript lists every metric as
+//
+//	> offset path timestamp
+//
+// followed by the result of the update if it reported one:
+//
+//	< metric assetID path timestamp type unit value [tags]
+//	< ack offset...
+//	< error message
+func Replay(d intf.Deriver, input string) ([]byte, error) {
+	file, err := os.Open(input)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buf := &bytes.Buffer{}
+	scanner := bufio.NewScanner(file)
+	var offset int64
+	var lineNo int
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+
+		m := &legacy.MetricSplit{}
+		if err := json.Unmarshal([]byte(line), m); err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", input, lineNo, err)
+		}
+		t := &erebos.Transport{
+			Value:     []byte(line),
+			Topic:     Topic,
+			Partition: 0,
+			Offset:    offset,
+		}
+		offset++
+
+		fmt.Fprintf(buf, "> %d %s %s\n", t.Offset, m.Path,
+			m.TS.UTC().Format(time.RFC3339))
+		derived, acks, ok, err := d.Update(m, t)
+		if err != nil {
+			fmt.Fprintf(buf, "< error %s\n", err.Error())
+			continue
+		}
+		if !ok {
+			continue
+		}
+		for i := range derived {
+			fmt.Fprintf(buf, "< metric %s\n", Format(derived[i]))
+		}
+		fmt.Fprintf(buf, "< ack%s\n", Offsets(acks))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Format returns the transcript representation of m
+func Format(m *legacy.MetricSplit) string {
+	var value string
+	switch v := m.Value().(type) {
+	case float64:
+		value = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		value = fmt.Sprintf("%v", v)
+	}
+	return fmt.Sprintf("%d %s %s %s %s %s [%s]", m.AssetID, m.Path,
+		m.TS.UTC().Format(time.RFC3339), m.Type, m.Unit, value,
+		strings.Join(m.Tags, ` `))
+}
+
+// Offsets returns the sorted offsets of acks, each preceded by a
+// space
+func Offsets(acks []*erebos.Transport) string {
+	offsets := make([]int, 0, len(acks))
+	for i := range acks {
+		offsets = append(offsets, int(acks[i].Offset))
+	}
+	sort.Ints(offsets)
+
+	var s string
+	for _, o := range offsets {
+		s += fmt.Sprintf(" %d", o)
+	}
+	return s
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
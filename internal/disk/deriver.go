@@ -9,26 +9,59 @@
 package disk // import "github.com/solnx/hurricane/internal/disk"
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/mjolnir42/erebos"
-	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/hurricane/internal/config"
 	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/registry"
+	"github.com/solnx/hurricane/internal/reorder"
+	"github.com/solnx/hurricane/internal/rollup"
 	"github.com/solnx/legacy"
 )
 
 // Implementation of the intf.Deriver interface
 
-// NewDeriver ...
-func NewDeriver(conf *erebos.Config) *Deriver {
+func init() {
+	registry.Register(`disk`, func(conf *erebos.Config, settings *config.Config, lookup intf.TagLookup) (intf.Deriver, error) {
+		d, err := NewDeriver(lookup, settings.Deriver(`disk`))
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	})
+}
+
+// NewDeriver returns a new Deriver. It returns an error if an option
+// in settings is invalid.
+func NewDeriver(lookup intf.TagLookup, settings config.Deriver) (*Deriver, error) {
 	d := &Deriver{}
 	d.data = make(map[int64]map[string]*dsk)
-	d.lookup = wall.NewLookup(conf, `hurricane`)
-	return d
+	d.lookup = lookup
+	d.window = time.Duration(settings.ReorderWindow) * time.Second
+	d.cycles = settings.ReorderCycles
+	d.totals = make(map[int64]*rollup.Rollup)
+
+	var err error
+	if d.history, err = fillHistory(settings); err != nil {
+		return nil, err
+	}
+	if d.exclude, err = rollupExclude(settings); err != nil {
+		return nil, err
+	}
+	return d, nil
 }
 
 // Deriver ...
 type Deriver struct {
-	data   map[int64]map[string]*dsk
-	lookup *wall.Lookup
+	data    map[int64]map[string]*dsk
+	lookup  intf.TagLookup
+	window  time.Duration
+	cycles  int
+	history time.Duration
+	exclude rollup.Exclude
+	totals  map[int64]*rollup.Rollup
 }
 
 // Start ...
@@ -48,6 +81,14 @@ func (d *Deriver) Register(m map[string]intf.Deriver) {
 		`/sys/disk/blk_used`,
 		`/sys/disk/blk_read`,
 		`/sys/disk/blk_wrtn`,
+		`/sys/disk/read_ops`,
+		`/sys/disk/write_ops`,
+		`/sys/disk/read_time`,
+		`/sys/disk/write_time`,
+		`/sys/disk/io_time`,
+		`/sys/disk/io_time_weighted`,
+		`/sys/disk/inode_total`,
+		`/sys/disk/inode_used`,
 	} {
 		m[s] = d
 	}
@@ -67,11 +108,100 @@ func (d *Deriver) Update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.
 
 	if _, ok := d.data[m.AssetID][mpt]; !ok {
 		d.data[m.AssetID][mpt] = &dsk{
-			lookup: d.lookup,
+			lookup:  d.lookup,
+			buffer:  reorder.New(d.window, d.cycles),
+			history: history{window: d.history},
+			report:  d.reporter(m.AssetID, mpt),
 		}
 	}
 
 	return d.data[m.AssetID][mpt].update(m, t)
 }
 
+// Snapshot ...
+func (d *Deriver) Snapshot() ([]byte, error) {
+	s := make(map[int64]map[string]state, len(d.data))
+	for assetID := range d.data {
+		s[assetID] = make(map[string]state, len(d.data[assetID]))
+		for mpt := range d.data[assetID] {
+			s[assetID][mpt] = d.data[assetID][mpt].export()
+		}
+	}
+	return json.Marshal(s)
+}
+
+// Restore ...
+func (d *Deriver) Restore(b []byte) error {
+	s := make(map[int64]map[string]state)
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	for assetID := range s {
+		if _, ok := d.data[assetID]; !ok {
+			d.data[assetID] = make(map[string]*dsk)
+		}
+		for mpt := range s[assetID] {
+			d.data[assetID][mpt] = &dsk{
+				lookup:  d.lookup,
+				buffer:  reorder.New(d.window, d.cycles),
+				history: history{window: d.history},
+				report:  d.reporter(assetID, mpt),
+			}
+			d.data[assetID][mpt].load(s[assetID][mpt])
+		}
+	}
+	return nil
+}
+
+// Evict ...
+func (d *Deriver) Evict(deadline time.Time) ([]*erebos.Transport, int) {
+	acks := []*erebos.Transport{}
+	var evicted int
+	for assetID := range d.data {
+		for mpt := range d.data[assetID] {
+			if d.data[assetID][mpt].lastSeen.Before(deadline) {
+				acks = append(acks, d.data[assetID][mpt].outstanding()...)
+				delete(d.data[assetID], mpt)
+				evicted++
+			}
+		}
+		if len(d.data[assetID]) == 0 {
+			delete(d.data, assetID)
+			delete(d.totals, assetID)
+		}
+	}
+	return acks, evicted
+}
+
+// Drop ...
+func (d *Deriver) Drop(assetID int64) []*erebos.Transport {
+	acks := []*erebos.Transport{}
+	for mpt := range d.data[assetID] {
+		acks = append(acks, d.data[assetID][mpt].outstanding()...)
+	}
+	delete(d.data, assetID)
+	delete(d.totals, assetID)
+	return acks
+}
+
+// Expire ...
+func (d *Deriver) Expire(deadline time.Time, partial bool) ([]*legacy.MetricSplit, []*erebos.Transport, int, int, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var dropped, evaluated int
+	for assetID := range d.data {
+		for mpt := range d.data[assetID] {
+			m, a, drp, evl, err := d.data[assetID][mpt].expire(deadline, partial)
+			if err != nil {
+				return nil, nil, 0, 0, err
+			}
+			derived = append(derived, m...)
+			acks = append(acks, a...)
+			dropped += drp
+			evaluated += evl
+		}
+	}
+	return derived, acks, dropped, evaluated, nil
+}
+
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
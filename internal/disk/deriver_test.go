@@ -0,0 +1,57 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package disk // import "github.com/solnx/hurricane/internal/disk"
+
+import (
+	"testing"
+
+	"github.com/solnx/hurricane/internal/config"
+	"github.com/solnx/hurricane/internal/derivertest"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/lookup"
+)
+
+func TestGolden(t *testing.T) {
+	derivertest.Suite(t, `testdata`, func(lookup intf.TagLookup) intf.Deriver {
+		d, err := NewDeriver(lookup, config.Deriver{
+			ReorderCycles: 2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
+
+func TestGoldenOptions(t *testing.T) {
+	derivertest.Suite(t, `testdata/options`, func(lookup intf.TagLookup) intf.Deriver {
+		d, err := NewDeriver(lookup, config.Deriver{
+			ReorderCycles: 2,
+			Options: map[string]string{
+				`rollup.exclude`: `/mnt/*`,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
+
+func TestInvalidOptions(t *testing.T) {
+	derivertest.InvalidOptions(t, func(settings config.Deriver) error {
+		_, err := NewDeriver(lookup.NewMemory(), settings)
+		return err
+	}, append([]derivertest.Option{
+		{Name: `fill.history.seconds`, Value: `0`},
+		{Name: `fill.history.seconds`, Value: `6h`},
+	}, derivertest.InvalidRollupOptions...))
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -11,6 +11,38 @@
 //	- disk.read.per.second
 //	- disk.free
 //	- disk.usage.percent
+//	- disk.read.iops
+//	- disk.write.iops
+//	- disk.await.ms
+//	- disk.utilization.percent
+//	- disk.queue.length
+//	- disk.inode.free
+//	- disk.inode.usage.percent
+//	- disk.growth.bytes.per.hour
+//	- disk.fill.eta.seconds
+//
+// The diskstats counters read_ops, write_ops, read_time, write_time,
+// io_time and io_time_weighted are optional. Once one of them has
+// been seen for a mountpoint, all of them are required for its
+// counters to be complete. The iops, await, utilization and queue
+// metrics are only derived for mountpoints that report them. The same
+// applies to the inode_total and inode_used counters and the inode
+// metrics.
+//
+// The growth of the used space is the least squares trend of the free
+// space over a sliding history, six hours by default. The timespan is
+// set by the deriver option fill.history.seconds. It is derived once
+// the history holds three samples, the time until the filesystem is
+// full only while the used space grows.
+//
+// The per asset total disk.usage.percent is derived once all
+// mountpoints of an asset have been derived for a measurement cycle.
+// The pseudo and in-memory filesystems mounted at or below /dev,
+// /proc, /run and /sys, the squashfs images below /snap and the
+// automounted network filesystems below /net are not part of the
+// total. Further mountpoints, like other network filesystems, are
+// excluded by the comma separated shell patterns of the deriver option
+// rollup.exclude.
 package disk // import "github.com/solnx/hurricane/internal/disk"
 
 import (
@@ -21,7 +53,9 @@ import (
 	"time"
 
 	"github.com/mjolnir42/erebos"
-	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/numeric"
+	"github.com/solnx/hurricane/internal/reorder"
 	"github.com/solnx/legacy"
 )
 
@@ -37,12 +71,21 @@ type dsk struct {
 	writeBps   float64
 	usage      float64
 	bytesFree  int64
-	lookup     *wall.Lookup
+	optional   optional
+	history    history
+	report     reportFunc
+	lookup     intf.TagLookup
 	ack        []*erebos.Transport
+	pending    []intf.Offset
+	lastSeen   time.Time
+	buffer     *reorder.Buffer
 }
 
 // Update adds m to the next counter tracked by d
 func (d *dsk) update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	// track activity for the eviction of idle state
+	d.lastSeen = time.Now()
+
 	// set assetID and mountpoint on first use
 	if d.assetID == 0 {
 		d.assetID = m.AssetID
@@ -61,42 +104,116 @@ func (d *dsk) update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.Metr
 		return []*legacy.MetricSplit{}, []*erebos.Transport{t}, true, nil
 	}
 
-processing:
-	if d.nextTime.IsZero() {
-		d.nextTime = m.TS
+	// redelivery of a message that is part of the restored state
+	pending, claimed := intf.Claim(d.pending, t)
+	d.pending = pending
+	if claimed {
+		d.ack = append(d.ack, t)
+		return nil, nil, false, nil
+	}
+
+	value, err := numeric.Int64(m)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	// optional counters are required once a valid value has been seen
+	switch m.Path {
+	case `/sys/disk/read_ops`, `/sys/disk/write_ops`,
+		`/sys/disk/read_time`, `/sys/disk/write_time`,
+		`/sys/disk/io_time`, `/sys/disk/io_time_weighted`:
+		d.optional.diskstats = true
+	case `/sys/disk/inode_total`, `/sys/disk/inode_used`:
+		d.optional.inodes = true
 	}
 
-	// out of order metric for old timestamp
-	if d.nextTime.After(m.TS) {
+	// metric for a measurement cycle that was already evaluated
+	if !d.currTime.IsZero() && !m.TS.After(d.currTime) {
 		return []*legacy.MetricSplit{}, []*erebos.Transport{t}, true, nil
 	}
 
-	// abandon current next and start new one
-	if d.nextTime.Before(m.TS) {
-		d.nextTime = time.Time{}
-		d.next = distribution{}
-		goto processing
-	}
-
-	if d.nextTime.Equal(m.TS) {
-		switch m.Path {
-		case `/sys/disk/blk_total`:
-			d.next.blkTotal = m.Value().(int64) * 1024
-			d.next.setBlkTotal = true
-		case `/sys/disk/blk_used`:
-			d.next.blkUsed = m.Value().(int64) * 1024
-			d.next.setBlkUsed = true
-		case `/sys/disk/blk_read`:
-			d.next.blkRead = m.Value().(int64) * 512
-			d.next.setBlkRead = true
-		case `/sys/disk/blk_wrtn`:
-			d.next.blkWrite = m.Value().(int64) * 512
-			d.next.setBlkWrite = true
-		}
+	e := d.buffer.Get(m.TS, func() interface{} {
+		return &distribution{}
+	})
+	next := e.Value.(*distribution)
+	switch m.Path {
+	case `/sys/disk/blk_total`:
+		next.blkTotal = value * 1024
+		next.setBlkTotal = true
+	case `/sys/disk/blk_used`:
+		next.blkUsed = value * 1024
+		next.setBlkUsed = true
+	case `/sys/disk/blk_read`:
+		next.blkRead = value * 512
+		next.setBlkRead = true
+	case `/sys/disk/blk_wrtn`:
+		next.blkWrite = value * 512
+		next.setBlkWrite = true
+	case `/sys/disk/read_ops`:
+		next.readOps = value
+		next.setReadOps = true
+	case `/sys/disk/write_ops`:
+		next.writeOps = value
+		next.setWriteOps = true
+	case `/sys/disk/read_time`:
+		next.readTime = value
+		next.setReadTime = true
+	case `/sys/disk/write_time`:
+		next.writeTime = value
+		next.setWriteTime = true
+	case `/sys/disk/io_time`:
+		next.ioTime = value
+		next.setIoTime = true
+	case `/sys/disk/io_time_weighted`:
+		next.ioTimeWeighted = value
+		next.setIoTimeWeighted = true
+	case `/sys/disk/inode_total`:
+		next.inodeTotal = value
+		next.setInodeTotal = true
+	case `/sys/disk/inode_used`:
+		next.inodeUsed = value
+		next.setInodeUsed = true
 	}
+	e.Acks = append(e.Acks, t)
+
+	// counters that fell out of the reorder window are abandoned
+	abandoned := d.buffer.Trim()
 
-	d.ack = append(d.ack, t)
-	return d.calculate()
+	derived, acks, ok, err := d.evaluate()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if len(abandoned) > 0 {
+		return derived, append(acks, abandoned...), true, nil
+	}
+	return derived, acks, ok, nil
+}
+
+// evaluate calculates the derived metrics for all complete counters at
+// the start of the reorder buffer in timestamp order. Evaluation stops
+// at the first incomplete counter.
+func (d *dsk) evaluate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var ok bool
+
+	for e := d.buffer.Oldest(); e != nil && e.Value.(*distribution).valid(d.optional); e = d.buffer.Oldest() {
+		d.buffer.Pop()
+		d.next = *e.Value.(*distribution)
+		d.nextTime = e.TS
+		d.ack = append(d.ack, e.Acks...)
+
+		m, a, done, err := d.calculate()
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if done {
+			derived = append(derived, m...)
+			acks = append(acks, a...)
+			ok = true
+		}
+	}
+	return derived, acks, ok, nil
 }
 
 // calculate checks if the next counter has been fully assembled and
@@ -105,7 +222,7 @@ processing:
 // it returns nil.
 func (d *dsk) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
 
-	if d.nextTime.IsZero() || !d.next.valid() {
+	if d.nextTime.IsZero() || !d.next.valid(d.optional) {
 		return nil, nil, false, nil
 	}
 
@@ -126,6 +243,7 @@ func (d *dsk) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, err
 
 	d.usage = floatUsage
 	d.bytesFree = bytesFree
+	d.history.add(d.nextTime, bytesFree)
 
 	// this is the first update
 	if d.currTime.IsZero() {
@@ -138,8 +256,14 @@ func (d *dsk) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, err
 	reads := d.next.blkRead - d.curr.blkRead
 	writes := d.next.blkWrite - d.curr.blkWrite
 
+	// diskstats are only derived if both counters report them
+	var stats *iostat
+	if d.curr.diskstats() && d.next.diskstats() {
+		stats = d.iostat(delta)
+	}
+
 	// counter wrapped
-	if reads < 0 || writes < 0 {
+	if reads < 0 || writes < 0 || (stats != nil && stats.wrapped) {
 		d.nextToCurrent()
 		return nil, nil, false, nil
 	}
@@ -150,15 +274,109 @@ func (d *dsk) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, err
 	d.writeBps = round(d.writeBps, .5, 2)
 
 	d.nextToCurrent()
-	derived, err := d.emitMetric()
+	derived, err := d.emitMetric(stats)
 	if err != nil {
 		return nil, nil, false, err
 	}
+	if d.report != nil {
+		totals, err := d.report(d.currTime, float64(d.curr.blkUsed),
+			float64(d.curr.blkTotal))
+		if err != nil {
+			return nil, nil, false, err
+		}
+		derived = append(derived, totals...)
+	}
 	acks := d.ack
 	d.ack = []*erebos.Transport{}
 	return derived, acks, true, nil
 }
 
+// iostat calculates the diskstats metrics between the current and
+// the next counter, which are delta seconds apart
+func (d *dsk) iostat(delta float64) *iostat {
+	readOps := d.next.readOps - d.curr.readOps
+	writeOps := d.next.writeOps - d.curr.writeOps
+	readTime := d.next.readTime - d.curr.readTime
+	writeTime := d.next.writeTime - d.curr.writeTime
+	ioTime := d.next.ioTime - d.curr.ioTime
+	ioTimeWeighted := d.next.ioTimeWeighted - d.curr.ioTimeWeighted
+
+	if readOps < 0 || writeOps < 0 || readTime < 0 || writeTime < 0 ||
+		ioTime < 0 || ioTimeWeighted < 0 {
+		return &iostat{wrapped: true}
+	}
+
+	stats := &iostat{
+		readIops:  round(float64(readOps)/delta, .5, 2),
+		writeIops: round(float64(writeOps)/delta, .5, 2),
+		queue:     round(float64(ioTimeWeighted)/(delta*1000), .5, 2),
+	}
+	if ops := readOps + writeOps; ops > 0 {
+		stats.await = round(float64(readTime+writeTime)/float64(ops), .5, 2)
+	}
+	// io_time is counted in milliseconds
+	stats.utilization = round(float64(ioTime)/(delta*1000)*100, .5, 2)
+	if stats.utilization > 100 {
+		stats.utilization = 100
+	}
+	return stats
+}
+
+// expire gives up on all counters in the reorder buffer that were
+// started before deadline and are still incomplete. If partial is
+// set, missing values are carried over from the current counter and
+// the result is evaluated. Otherwise, or if the result can still not
+// be evaluated, the counter is dropped and its acknowledgements are
+// released. Complete counters that were waiting for the expired ones
+// are evaluated afterwards. It returns the number of dropped and
+// partially evaluated counters.
+func (d *dsk) expire(deadline time.Time, partial bool) ([]*legacy.MetricSplit, []*erebos.Transport, int, int, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var dropped, evaluated int
+
+	for e := d.buffer.Oldest(); e != nil && e.Start.Before(deadline); e = d.buffer.Oldest() {
+		d.buffer.Pop()
+		next := e.Value.(*distribution)
+		if !next.valid(d.optional) && partial && !d.currTime.IsZero() {
+			next.fill(&d.curr)
+			if next.valid(d.optional) {
+				evaluated++
+			}
+		}
+		if !next.valid(d.optional) {
+			acks = append(acks, e.Acks...)
+			dropped++
+			continue
+		}
+
+		d.next = *next
+		d.nextTime = e.TS
+		d.ack = append(d.ack, e.Acks...)
+		m, a, ok, err := d.calculate()
+		if err != nil {
+			return nil, nil, 0, 0, err
+		}
+		if ok {
+			derived = append(derived, m...)
+			acks = append(acks, a...)
+		}
+	}
+
+	m, a, _, err := d.evaluate()
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	derived = append(derived, m...)
+	acks = append(acks, a...)
+	return derived, acks, dropped, evaluated, nil
+}
+
+// outstanding returns all acknowledgements held by d
+func (d *dsk) outstanding() []*erebos.Transport {
+	return append(d.buffer.Acks(), d.ack...)
+}
+
 // nextToCurrent advances the counters within d by one step
 func (d *dsk) nextToCurrent() {
 	d.currTime = d.nextTime
@@ -168,8 +386,9 @@ func (d *dsk) nextToCurrent() {
 	d.next = distribution{}
 }
 
-// emitMetric returns the derived metrics for the current counter
-func (d *dsk) emitMetric() ([]*legacy.MetricSplit, error) {
+// emitMetric returns the derived metrics for the current counter,
+// including the diskstats metrics in stats if it is not nil
+func (d *dsk) emitMetric(stats *iostat) ([]*legacy.MetricSplit, error) {
 	dwps := &legacy.MetricSplit{
 		AssetID: d.assetID,
 		Path: fmt.Sprintf("disk.write.per.second:%s",
@@ -181,13 +400,6 @@ func (d *dsk) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: d.writeBps,
 		},
 	}
-	if tags, err := d.lookup.GetConfigurationID(
-		dwps.LookupID(),
-	); err == nil {
-		dwps.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		return []*legacy.MetricSplit{}, err
-	}
 
 	drps := &legacy.MetricSplit{
 		AssetID: d.assetID,
@@ -200,13 +412,6 @@ func (d *dsk) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: d.readBps,
 		},
 	}
-	if tags, err := d.lookup.GetConfigurationID(
-		drps.LookupID(),
-	); err == nil {
-		drps.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		return []*legacy.MetricSplit{}, err
-	}
 
 	df := &legacy.MetricSplit{
 		AssetID: d.assetID,
@@ -219,13 +424,6 @@ func (d *dsk) emitMetric() ([]*legacy.MetricSplit, error) {
 			IntVal: d.bytesFree,
 		},
 	}
-	if tags, err := d.lookup.GetConfigurationID(
-		df.LookupID(),
-	); err == nil {
-		df.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		return []*legacy.MetricSplit{}, err
-	}
 
 	dup := &legacy.MetricSplit{
 		AssetID: d.assetID,
@@ -238,33 +436,197 @@ func (d *dsk) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: d.usage,
 		},
 	}
-	if tags, err := d.lookup.GetConfigurationID(
-		dup.LookupID(),
-	); err == nil {
-		dup.Tags = tags
-	} else if err != wall.ErrUnconfigured {
+
+	result := []*legacy.MetricSplit{dwps, drps, df, dup}
+	if growth, ok := d.history.growth(); ok {
+		result = append(result, &legacy.MetricSplit{
+			AssetID: d.assetID,
+			Path: fmt.Sprintf("disk.growth.bytes.per.hour:%s",
+				d.mountpoint),
+			TS:   d.currTime,
+			Type: `real`,
+			Unit: `B`,
+			Val: legacy.MetricValue{
+				FlpVal: round(growth*3600, .5, 2),
+			},
+		})
+		if growth > 0 {
+			eta := float64(d.bytesFree) / growth
+			if eta < 0 {
+				eta = 0
+			}
+			result = append(result, &legacy.MetricSplit{
+				AssetID: d.assetID,
+				Path: fmt.Sprintf("disk.fill.eta.seconds:%s",
+					d.mountpoint),
+				TS:   d.currTime,
+				Type: `integer`,
+				Unit: `s`,
+				Val: legacy.MetricValue{
+					IntVal: int64(math.Floor(eta + .5)),
+				},
+			})
+		}
+	}
+	if d.curr.inodes() && d.curr.inodeTotal > 0 {
+		result = append(result, &legacy.MetricSplit{
+			AssetID: d.assetID,
+			Path: fmt.Sprintf("disk.inode.free:%s",
+				d.mountpoint),
+			TS:   d.currTime,
+			Type: `integer`,
+			Unit: `#`,
+			Val: legacy.MetricValue{
+				IntVal: d.curr.inodeTotal - d.curr.inodeUsed,
+			},
+		}, &legacy.MetricSplit{
+			AssetID: d.assetID,
+			Path: fmt.Sprintf("disk.inode.usage.percent:%s",
+				d.mountpoint),
+			TS:   d.currTime,
+			Type: `real`,
+			Unit: `%`,
+			Val: legacy.MetricValue{
+				FlpVal: round(float64(d.curr.inodeUsed)/
+					float64(d.curr.inodeTotal)*100, .5, 2),
+			},
+		})
+	}
+	if stats != nil {
+		for _, v := range []struct {
+			name  string
+			unit  string
+			value float64
+		}{
+			{`disk.read.iops`, `#`, stats.readIops},
+			{`disk.write.iops`, `#`, stats.writeIops},
+			{`disk.await.ms`, `ms`, stats.await},
+			{`disk.utilization.percent`, `%`, stats.utilization},
+			{`disk.queue.length`, `#`, stats.queue},
+		} {
+			result = append(result, &legacy.MetricSplit{
+				AssetID: d.assetID,
+				Path: fmt.Sprintf("%s:%s",
+					v.name, d.mountpoint),
+				TS:   d.currTime,
+				Type: `real`,
+				Unit: v.unit,
+				Val: legacy.MetricValue{
+					FlpVal: v.value,
+				},
+			})
+		}
+	}
+	if err := intf.LookupTags(d.lookup, result); err != nil {
+		// do not emit potentially incorrect metrics
 		return []*legacy.MetricSplit{}, err
 	}
+	return result, nil
+}
+
+// optional records which optional counters are reported for a
+// mountpoint
+type optional struct {
+	diskstats bool
+	inodes    bool
+}
 
-	return []*legacy.MetricSplit{dwps, drps, df, dup}, nil
+// iostat holds the diskstats metrics derived from two counters
+type iostat struct {
+	wrapped     bool
+	readIops    float64
+	writeIops   float64
+	await       float64
+	utilization float64
+	queue       float64
 }
 
 // distribution is used to track multiple disk metrics from the same
 // measurement cycle
 type distribution struct {
-	setBlkTotal bool
-	setBlkUsed  bool
-	setBlkRead  bool
-	setBlkWrite bool
-	blkTotal    int64
-	blkUsed     int64
-	blkRead     int64
-	blkWrite    int64
+	setBlkTotal       bool
+	setBlkUsed        bool
+	setBlkRead        bool
+	setBlkWrite       bool
+	setReadOps        bool
+	setWriteOps       bool
+	setReadTime       bool
+	setWriteTime      bool
+	setIoTime         bool
+	setIoTimeWeighted bool
+	setInodeTotal     bool
+	setInodeUsed      bool
+	blkTotal          int64
+	blkUsed           int64
+	blkRead           int64
+	blkWrite          int64
+	readOps           int64
+	writeOps          int64
+	readTime          int64
+	writeTime         int64
+	ioTime            int64
+	ioTimeWeighted    int64
+	inodeTotal        int64
+	inodeUsed         int64
+}
+
+// valid checks if a counter has been fully populated, including the
+// optional counters reported for the mountpoint
+func (d *distribution) valid(o optional) bool {
+	return d.setBlkTotal && d.setBlkUsed && d.setBlkRead &&
+		d.setBlkWrite && (d.diskstats() || !o.diskstats) &&
+		(d.inodes() || !o.inodes)
+}
+
+// diskstats checks if all diskstats counters have been populated
+func (d *distribution) diskstats() bool {
+	return d.setReadOps && d.setWriteOps && d.setReadTime &&
+		d.setWriteTime && d.setIoTime && d.setIoTimeWeighted
 }
 
-// valid checks if a counter has been fully populated
-func (d *distribution) valid() bool {
-	return d.setBlkTotal && d.setBlkUsed && d.setBlkRead && d.setBlkWrite
+// inodes checks if all inode counters have been populated
+func (d *distribution) inodes() bool {
+	return d.setInodeTotal && d.setInodeUsed
+}
+
+// fill copies the values that are missing in d from prev
+func (d *distribution) fill(prev *distribution) {
+	if !d.setBlkTotal && prev.setBlkTotal {
+		d.blkTotal, d.setBlkTotal = prev.blkTotal, true
+	}
+	if !d.setBlkUsed && prev.setBlkUsed {
+		d.blkUsed, d.setBlkUsed = prev.blkUsed, true
+	}
+	if !d.setBlkRead && prev.setBlkRead {
+		d.blkRead, d.setBlkRead = prev.blkRead, true
+	}
+	if !d.setBlkWrite && prev.setBlkWrite {
+		d.blkWrite, d.setBlkWrite = prev.blkWrite, true
+	}
+	if !d.setReadOps && prev.setReadOps {
+		d.readOps, d.setReadOps = prev.readOps, true
+	}
+	if !d.setWriteOps && prev.setWriteOps {
+		d.writeOps, d.setWriteOps = prev.writeOps, true
+	}
+	if !d.setReadTime && prev.setReadTime {
+		d.readTime, d.setReadTime = prev.readTime, true
+	}
+	if !d.setWriteTime && prev.setWriteTime {
+		d.writeTime, d.setWriteTime = prev.writeTime, true
+	}
+	if !d.setIoTime && prev.setIoTime {
+		d.ioTime, d.setIoTime = prev.ioTime, true
+	}
+	if !d.setIoTimeWeighted && prev.setIoTimeWeighted {
+		d.ioTimeWeighted, d.setIoTimeWeighted = prev.ioTimeWeighted, true
+	}
+	if !d.setInodeTotal && prev.setInodeTotal {
+		d.inodeTotal, d.setInodeTotal = prev.inodeTotal, true
+	}
+	if !d.setInodeUsed && prev.setInodeUsed {
+		d.inodeUsed, d.setInodeUsed = prev.inodeUsed, true
+	}
 }
 
 // https://gist.github.com/DavidVaini/10308388
@@ -0,0 +1,106 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package disk // import "github.com/solnx/hurricane/internal/disk"
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/solnx/hurricane/internal/config"
+)
+
+const (
+	// option to set the timespan of the free space history
+	optionHistory = `fill.history.seconds`
+	// default timespan of the free space history
+	defaultHistory = 6 * time.Hour
+	// minimum number of samples required to derive a trend
+	minSamples = 3
+	// maximum number of samples kept per mountpoint
+	maxSamples = 1024
+)
+
+// fillHistory returns the timespan of the free space history
+// configured in settings
+func fillHistory(settings config.Deriver) (time.Duration, error) {
+	v, ok := settings.Options[optionHistory]
+	if !ok {
+		return defaultHistory, nil
+	}
+	seconds, err := strconv.Atoi(v)
+	if err != nil || seconds <= 0 {
+		return defaultHistory, fmt.Errorf(
+			"disk: invalid option %s: %s", optionHistory, v)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// sample is the free space of a mountpoint at one point in time
+type sample struct {
+	ts   time.Time
+	free int64
+}
+
+// history is a sliding window of free space samples
+type history struct {
+	window  time.Duration
+	samples []sample
+}
+
+// add appends the free space at ts to h and removes the samples that
+// fell out of the window
+func (h *history) add(ts time.Time, free int64) {
+	h.samples = append(h.samples, sample{ts: ts, free: free})
+
+	deadline := ts.Add(-h.window)
+	i := 0
+	for i < len(h.samples) && h.samples[i].ts.Before(deadline) {
+		i++
+	}
+	if len(h.samples)-i > maxSamples {
+		i = len(h.samples) - maxSamples
+	}
+	if i > 0 {
+		h.samples = append([]sample{}, h.samples[i:]...)
+	}
+}
+
+// growth returns the growth of the used space in bytes per second,
+// calculated by a least squares fit of the free space over time. It
+// returns false if there are not enough samples to derive a trend.
+func (h *history) growth() (float64, bool) {
+	n := float64(len(h.samples))
+	if len(h.samples) < minSamples {
+		return 0, false
+	}
+
+	// times are relative to the first sample to keep the sums small
+	start := h.samples[0].ts
+	var sumX, sumY float64
+	for _, s := range h.samples {
+		sumX += s.ts.Sub(start).Seconds()
+		sumY += float64(s.free)
+	}
+	meanX, meanY := sumX/n, sumY/n
+
+	var cov, variance float64
+	for _, s := range h.samples {
+		dx := s.ts.Sub(start).Seconds() - meanX
+		cov += dx * (float64(s.free) - meanY)
+		variance += dx * dx
+	}
+	if variance == 0 {
+		return 0, false
+	}
+	// free space shrinks as the used space grows
+	return -cov / variance, true
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
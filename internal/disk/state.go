@@ -0,0 +1,209 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package disk // import "github.com/solnx/hurricane/internal/disk"
+
+import (
+	"time"
+
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/reorder"
+)
+
+// state is the serializable form of dsk
+type state struct {
+	AssetID    int64             `json:"asset.id"`
+	Curr       distributionState `json:"curr"`
+	CurrTime   time.Time         `json:"curr.time"`
+	Buffer     []cycleState      `json:"buffer"`
+	Mountpoint string            `json:"mountpoint"`
+	ReadBps    float64           `json:"read.bps"`
+	WriteBps   float64           `json:"write.bps"`
+	Usage      float64           `json:"usage"`
+	BytesFree  int64             `json:"bytes.free"`
+	Optional   optionalState     `json:"optional"`
+	History    []sampleState     `json:"history"`
+	Ack        []intf.Offset     `json:"ack"`
+}
+
+// optionalState is the serializable form of optional
+type optionalState struct {
+	Diskstats bool `json:"diskstats"`
+	Inodes    bool `json:"inodes"`
+}
+
+// sampleState is the serializable form of sample
+type sampleState struct {
+	TS   time.Time `json:"ts"`
+	Free int64     `json:"free"`
+}
+
+// cycleState is the serializable form of a reorder buffer entry
+type cycleState struct {
+	TS   time.Time         `json:"ts"`
+	Next distributionState `json:"next"`
+}
+
+// distributionState is the serializable form of distribution
+type distributionState struct {
+	SetBlkTotal       bool  `json:"set.blk.total"`
+	SetBlkUsed        bool  `json:"set.blk.used"`
+	SetBlkRead        bool  `json:"set.blk.read"`
+	SetBlkWrite       bool  `json:"set.blk.write"`
+	BlkTotal          int64 `json:"blk.total"`
+	BlkUsed           int64 `json:"blk.used"`
+	BlkRead           int64 `json:"blk.read"`
+	BlkWrite          int64 `json:"blk.write"`
+	SetReadOps        bool  `json:"set.read.ops"`
+	SetWriteOps       bool  `json:"set.write.ops"`
+	SetReadTime       bool  `json:"set.read.time"`
+	SetWriteTime      bool  `json:"set.write.time"`
+	SetIoTime         bool  `json:"set.io.time"`
+	SetIoTimeWeighted bool  `json:"set.io.time.weighted"`
+	ReadOps           int64 `json:"read.ops"`
+	WriteOps          int64 `json:"write.ops"`
+	ReadTime          int64 `json:"read.time"`
+	WriteTime         int64 `json:"write.time"`
+	IoTime            int64 `json:"io.time"`
+	IoTimeWeighted    int64 `json:"io.time.weighted"`
+	SetInodeTotal     bool  `json:"set.inode.total"`
+	SetInodeUsed      bool  `json:"set.inode.used"`
+	InodeTotal        int64 `json:"inode.total"`
+	InodeUsed         int64 `json:"inode.used"`
+}
+
+// export returns the serializable state of d. Outstanding
+// acknowledgements are exported as offsets.
+func (d *dsk) export() state {
+	s := state{
+		AssetID:    d.assetID,
+		Curr:       d.curr.export(),
+		CurrTime:   d.currTime,
+		Buffer:     []cycleState{},
+		History:    []sampleState{},
+		Mountpoint: d.mountpoint,
+		ReadBps:    d.readBps,
+		WriteBps:   d.writeBps,
+		Usage:      d.usage,
+		BytesFree:  d.bytesFree,
+		Optional: optionalState{
+			Diskstats: d.optional.diskstats,
+			Inodes:    d.optional.inodes,
+		},
+		Ack: append(intf.Offsets(d.outstanding()), d.pending...),
+	}
+	for _, smp := range d.history.samples {
+		s.History = append(s.History, sampleState{
+			TS:   smp.ts,
+			Free: smp.free,
+		})
+	}
+	for _, e := range d.buffer.Entries() {
+		s.Buffer = append(s.Buffer, cycleState{
+			TS:   e.TS,
+			Next: e.Value.(*distribution).export(),
+		})
+	}
+	return s
+}
+
+// load sets d to the state s. The acknowledgements in s are stored
+// as pending until their messages are redelivered.
+func (d *dsk) load(s state) {
+	d.assetID = s.AssetID
+	d.curr = s.Curr.load()
+	d.currTime = s.CurrTime
+	for i := range s.Buffer {
+		next := s.Buffer[i].Next.load()
+		d.buffer.Insert(&reorder.Entry{
+			TS:    s.Buffer[i].TS,
+			Start: time.Now(),
+			Value: &next,
+		})
+	}
+	d.mountpoint = s.Mountpoint
+	d.readBps = s.ReadBps
+	d.writeBps = s.WriteBps
+	d.usage = s.Usage
+	d.bytesFree = s.BytesFree
+	d.optional = optional{
+		diskstats: s.Optional.Diskstats,
+		inodes:    s.Optional.Inodes,
+	}
+	d.history.samples = make([]sample, 0, len(s.History))
+	for _, smp := range s.History {
+		d.history.samples = append(d.history.samples, sample{
+			ts:   smp.TS,
+			free: smp.Free,
+		})
+	}
+	d.pending = s.Ack
+	d.lastSeen = time.Now()
+}
+
+// export returns the serializable state of d
+func (d *distribution) export() distributionState {
+	return distributionState{
+		SetBlkTotal:       d.setBlkTotal,
+		SetBlkUsed:        d.setBlkUsed,
+		SetBlkRead:        d.setBlkRead,
+		SetBlkWrite:       d.setBlkWrite,
+		BlkTotal:          d.blkTotal,
+		BlkUsed:           d.blkUsed,
+		BlkRead:           d.blkRead,
+		BlkWrite:          d.blkWrite,
+		SetReadOps:        d.setReadOps,
+		SetWriteOps:       d.setWriteOps,
+		SetReadTime:       d.setReadTime,
+		SetWriteTime:      d.setWriteTime,
+		SetIoTime:         d.setIoTime,
+		SetIoTimeWeighted: d.setIoTimeWeighted,
+		ReadOps:           d.readOps,
+		WriteOps:          d.writeOps,
+		ReadTime:          d.readTime,
+		WriteTime:         d.writeTime,
+		IoTime:            d.ioTime,
+		IoTimeWeighted:    d.ioTimeWeighted,
+		SetInodeTotal:     d.setInodeTotal,
+		SetInodeUsed:      d.setInodeUsed,
+		InodeTotal:        d.inodeTotal,
+		InodeUsed:         d.inodeUsed,
+	}
+}
+
+// load returns the distribution described by s
+func (s distributionState) load() distribution {
+	return distribution{
+		setBlkTotal:       s.SetBlkTotal,
+		setBlkUsed:        s.SetBlkUsed,
+		setBlkRead:        s.SetBlkRead,
+		setBlkWrite:       s.SetBlkWrite,
+		blkTotal:          s.BlkTotal,
+		blkUsed:           s.BlkUsed,
+		blkRead:           s.BlkRead,
+		blkWrite:          s.BlkWrite,
+		setReadOps:        s.SetReadOps,
+		setWriteOps:       s.SetWriteOps,
+		setReadTime:       s.SetReadTime,
+		setWriteTime:      s.SetWriteTime,
+		setIoTime:         s.SetIoTime,
+		setIoTimeWeighted: s.SetIoTimeWeighted,
+		readOps:           s.ReadOps,
+		writeOps:          s.WriteOps,
+		readTime:          s.ReadTime,
+		writeTime:         s.WriteTime,
+		ioTime:            s.IoTime,
+		ioTimeWeighted:    s.IoTimeWeighted,
+		setInodeTotal:     s.SetInodeTotal,
+		setInodeUsed:      s.SetInodeUsed,
+		inodeTotal:        s.InodeTotal,
+		inodeUsed:         s.InodeUsed,
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,105 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package disk // import "github.com/solnx/hurricane/internal/disk"
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/solnx/hurricane/internal/config"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/rollup"
+	"github.com/solnx/legacy"
+)
+
+// option to exclude mountpoints from the per asset totals
+const optionExclude = `rollup.exclude`
+
+// defaultExclude are the mountpoints of pseudo and in-memory
+// filesystems and of automounted network filesystems. They and all
+// mountpoints below them are always excluded from the per asset totals.
+var defaultExclude = []string{`/dev`, `/net`, `/proc`, `/run`, `/snap`, `/sys`}
+
+// reportFunc is called by a dsk with the used and total bytes of a
+// measurement cycle and returns the derived per asset totals once the
+// cycle is complete for all mountpoints of the asset
+type reportFunc func(ts time.Time, values ...float64) ([]*legacy.MetricSplit, error)
+
+// rollupExclude returns the mountpoint patterns configured in settings
+// that are excluded from the per asset totals
+func rollupExclude(settings config.Deriver) (rollup.Exclude, error) {
+	e, err := rollup.ParseExclude(settings.Options[optionExclude])
+	if err != nil {
+		return nil, fmt.Errorf("disk: invalid option %s: %s",
+			optionExclude, err.Error())
+	}
+	return e, nil
+}
+
+// excluded checks if the mountpoint mpt is not part of the per asset
+// totals
+func (d *Deriver) excluded(mpt string) bool {
+	for _, dir := range defaultExclude {
+		if mpt == dir || strings.HasPrefix(mpt, dir+`/`) {
+			return true
+		}
+	}
+	return d.exclude.Match(mpt)
+}
+
+// reporter returns the reportFunc of mountpoint mpt of assetID. It
+// returns nil for excluded mountpoints.
+func (d *Deriver) reporter(assetID int64, mpt string) reportFunc {
+	if d.excluded(mpt) {
+		return nil
+	}
+	return func(ts time.Time, values ...float64) ([]*legacy.MetricSplit, error) {
+		return d.total(assetID, mpt, ts, values)
+	}
+}
+
+// total adds the used and total bytes of mountpoint mpt of assetID for
+// the measurement cycle ts and returns the per asset totals if all
+// mountpoints have reported the cycle
+func (d *Deriver) total(assetID int64, mpt string, ts time.Time, values []float64) ([]*legacy.MetricSplit, error) {
+	if _, ok := d.totals[assetID]; !ok {
+		d.totals[assetID] = rollup.New()
+	}
+	members := []string{}
+	for name := range d.data[assetID] {
+		if !d.excluded(name) {
+			members = append(members, name)
+		}
+	}
+
+	sums, ok := d.totals[assetID].Add(ts, mpt, values, members)
+	if !ok || sums[1] <= 0 {
+		return nil, nil
+	}
+	result := []*legacy.MetricSplit{
+		{
+			AssetID: assetID,
+			Path:    `disk.usage.percent`,
+			TS:      ts,
+			Type:    `real`,
+			Unit:    `%`,
+			Val: legacy.MetricValue{
+				FlpVal: round(sums[0]/sums[1]*100, .5, 2),
+			},
+		},
+	}
+	if err := intf.LookupTags(d.lookup, result); err != nil {
+		// do not emit potentially incorrect metrics
+		return nil, err
+	}
+	return result, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -11,10 +11,15 @@ package hurricane // import "github.com/solnx/hurricane/internal/hurricane"
 import (
 	"runtime"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/mjolnir42/erebos"
 	"github.com/solnx/legacy"
 )
 
+// unroutable is the HostID of messages whose host could not be
+// determined
+const unroutable = -1
+
 // Implementation of the erebos.Dispatcher interface
 
 // Dispatch routes msg to the correct Handler instance
@@ -22,10 +27,20 @@ func Dispatch(msg erebos.Transport) error {
 	// send all messages from the same host to the same handler
 	hostID, err := legacy.PeekHostID(msg.Value)
 	if err != nil {
-		return err
+		// the first handler rejects the message, so that it is
+		// dead lettered and its offset committed
+		logrus.Warnf("Rejecting message without host ID: %s",
+			err.Error())
+		msg.HostID = unroutable
+		tracker.track(&msg)
+		Handlers[0].InputChannel() <- &msg
+		return nil
 	}
 	msg.HostID = hostID
 
+	// register the offset before any handler can process it
+	tracker.track(&msg)
+
 	Handlers[hostID%runtime.NumCPU()].InputChannel() <- &msg
 	return nil
 }
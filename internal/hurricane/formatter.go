@@ -32,6 +32,24 @@ func FormatMetrics(batch *legacy.PluginMetricBatch) func(string, interface{}) {
 					FlpVal: value.Rate1(),
 				},
 			})
+		case *metrics.StandardCounter:
+			value := v.(*metrics.StandardCounter)
+			batch.Metrics = append(batch.Metrics, legacy.PluginMetric{
+				Type:   `integer`,
+				Metric: metric,
+				Value: legacy.MetricValue{
+					IntVal: value.Count(),
+				},
+			})
+		case *metrics.StandardGauge:
+			value := v.(*metrics.StandardGauge)
+			batch.Metrics = append(batch.Metrics, legacy.PluginMetric{
+				Type:   `integer`,
+				Metric: metric,
+				Value: legacy.MetricValue{
+					IntVal: value.Value(),
+				},
+			})
 		}
 	}
 }
@@ -45,6 +63,14 @@ func DebugFormatMetrics(_ *legacy.PluginMetricBatch) func(string, interface{}) {
 			value := v.(*metrics.StandardMeter)
 			fmt.Fprintf(os.Stderr, "%s/avg/rate/1min: %f\n",
 				metric, value.Rate1())
+		case *metrics.StandardCounter:
+			value := v.(*metrics.StandardCounter)
+			fmt.Fprintf(os.Stderr, "%s: %d\n",
+				metric, value.Count())
+		case *metrics.StandardGauge:
+			value := v.(*metrics.StandardGauge)
+			fmt.Fprintf(os.Stderr, "%s: %d\n",
+				metric, value.Value())
 		}
 	}
 }
@@ -14,14 +14,12 @@ import (
 	"time"
 
 	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
 	"github.com/mjolnir42/delay"
 	"github.com/mjolnir42/erebos"
 	wall "github.com/solnx/eye/lib/eye.wall"
-	"github.com/solnx/hurricane/internal/cpu"
-	"github.com/solnx/hurricane/internal/ctx"
-	"github.com/solnx/hurricane/internal/disk"
-	"github.com/solnx/hurricane/internal/mem"
-	"github.com/solnx/hurricane/internal/netif"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/registry"
 	kazoo "github.com/wvanbergen/kazoo-go"
 )
 
@@ -35,21 +33,15 @@ func (h *Hurricane) Start() {
 		return
 	}
 
-	kz, err := kazoo.NewKazooFromConnectionString(
-		h.Config.Zookeeper.Connect, nil)
-	if err != nil {
-		h.Death <- err
-		<-h.Shutdown
-		return
+	if h.Brokers == nil {
+		h.Brokers = zookeeperBrokers
 	}
-	brokers, err := kz.BrokerList()
+	brokers, err := h.Brokers(h.Config)
 	if err != nil {
-		kz.Close()
 		h.Death <- err
 		<-h.Shutdown
 		return
 	}
-	kz.Close()
 
 	host, err := os.Hostname()
 	if err != nil {
@@ -92,12 +84,22 @@ func (h *Hurricane) Start() {
 		config.Producer.Retry.Max = h.Config.Kafka.ProducerRetry
 	}
 	config.Producer.Partitioner = sarama.NewHashPartitioner
+	// the record headers of dead letters require Kafka 0.11
+	if h.deadLetterTopic() != `` && !config.Version.IsAtLeast(sarama.V0_11_0_0) {
+		config.Version = sarama.V0_11_0_0
+	}
 	config.ClientID = fmt.Sprintf("hurricane.%s", host)
 
 	h.trackID = make(map[string]int)
 	h.trackACK = make(map[string][]*erebos.Transport)
+	h.deriver = make(map[string][]intf.Deriver)
+	h.enabled = make(map[string]intf.Deriver)
+	h.refs = make(map[*erebos.Transport]int)
 
-	h.producer, err = sarama.NewAsyncProducer(brokers, config)
+	if h.NewProducer == nil {
+		h.NewProducer = sarama.NewAsyncProducer
+	}
+	h.producer, err = h.NewProducer(brokers, config)
 	if err != nil {
 		h.Death <- err
 		<-h.Shutdown
@@ -105,68 +107,62 @@ func (h *Hurricane) Start() {
 	}
 	h.dispatch = h.producer.Input()
 	h.delay = delay.New()
+	h.inflight = delay.New()
 
-	h.lookup = wall.NewLookup(h.Config, `hurricane`)
-	defer h.lookup.Close()
-
-	if h.Config.Hurricane.DeriveCTX {
-		ctxDeriver := ctx.NewDeriver(h.Config)
-		if err := ctxDeriver.Start(); err != nil {
-			h.Death <- err
-			<-h.Shutdown
-			return
-		}
-		ctxDeriver.Register(h.deriver)
-		defer ctxDeriver.Close()
+	if h.Lookup == nil {
+		h.Lookup = wall.NewLookup(h.Config, `hurricane`)
+	}
+	if err := h.Lookup.Start(); err != nil {
+		h.Death <- err
+		<-h.Shutdown
+		return
 	}
+	defer h.Lookup.Close()
 
-	if h.Config.Hurricane.DeriveCPU {
-		cpuDeriver := cpu.NewDeriver(h.Config)
-		if err := cpuDeriver.Start(); err != nil {
+	for _, name := range h.Settings.Enabled(h.Config) {
+		deriver, err := registry.New(name, h.Config, h.Settings, h.Lookup)
+		if err != nil {
 			h.Death <- err
 			<-h.Shutdown
 			return
 		}
-		cpuDeriver.Register(h.deriver)
-		defer cpuDeriver.Close()
-	}
-
-	if h.Config.Hurricane.DeriveMEM {
-		memDeriver := mem.NewDeriver(h.Config)
-		if err := memDeriver.Start(); err != nil {
+		if err := deriver.Start(); err != nil {
 			h.Death <- err
 			<-h.Shutdown
 			return
 		}
-		memDeriver.Register(h.deriver)
-		defer memDeriver.Close()
-	}
+		defer deriver.Close()
 
-	if h.Config.Hurricane.DeriveDISK {
-		dskDeriver := disk.NewDeriver(h.Config)
-		if err := dskDeriver.Start(); err != nil {
-			h.Death <- err
-			<-h.Shutdown
-			return
+		// every deriver registered for a path receives its metrics
+		paths := make(map[string]intf.Deriver)
+		deriver.Register(paths)
+		for path := range paths {
+			h.deriver[path] = append(h.deriver[path], paths[path])
 		}
-		dskDeriver.Register(h.deriver)
-		defer dskDeriver.Close()
+		h.enabled[name] = deriver
 	}
 
-	if h.Config.Hurricane.DeriveNETIF {
-		netifDeriver := netif.NewDeriver(h.Config)
-		if err := netifDeriver.Start(); err != nil {
-			h.Death <- err
-			<-h.Shutdown
-			return
-		}
-		netifDeriver.Register(h.deriver)
-		defer netifDeriver.Close()
+	// restore the deriver state from the last shutdown
+	if err := h.restore(); err != nil {
+		logrus.Warnf("Handler #%d: could not restore state: %s",
+			h.Num, err.Error())
 	}
 
 	h.run()
 }
 
+// zookeeperBrokers returns the Kafka brokers registered in ZooKeeper
+func zookeeperBrokers(conf *erebos.Config) ([]string, error) {
+	kz, err := kazoo.NewKazooFromConnectionString(
+		conf.Zookeeper.Connect, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer kz.Close()
+
+	return kz.BrokerList()
+}
+
 // InputChannel returns the data input channel
 func (h *Hurricane) InputChannel() chan *erebos.Transport {
 	return h.Input
@@ -15,18 +15,26 @@ import (
 	"github.com/mjolnir42/delay"
 	"github.com/mjolnir42/erebos"
 	metrics "github.com/rcrowley/go-metrics"
-	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/hurricane/internal/config"
+	"github.com/solnx/hurricane/internal/deadletter"
 	"github.com/solnx/hurricane/internal/intf"
 )
 
 // Handlers is the registry of running application handlers
 var Handlers map[int]erebos.Handler
 
+// tracker records the consumed offsets of all handlers
+var tracker *offsetTracker
+
 // init function sets up package variables
 func init() {
 	// Handlers tracks all Hurricane instances and is used by
 	// Dispatch() to find the correct instance to route the message to
 	Handlers = make(map[int]erebos.Handler)
+
+	// tracker is used by Dispatch() to register consumed offsets and
+	// by the handlers to commit only fully processed offset ranges
+	tracker = newOffsetTracker()
 }
 
 // Hurricane calculates and produces derived metrics
@@ -37,14 +45,31 @@ type Hurricane struct {
 	Death    chan error
 	Config   *erebos.Config
 	Metrics  *metrics.Registry
+	Settings *config.Config
+	// lookup shared by the handler and its derivers, a handler
+	// specific eyewall lookup is used if unset
+	Lookup intf.TagLookup
+	// dead letter spool shared by all handlers, rejected input
+	// messages are not spooled if unset
+	Spool *deadletter.Spool
+	// Brokers returns the Kafka brokers to produce to, the brokers
+	// registered in ZooKeeper are used if unset
+	Brokers func(conf *erebos.Config) ([]string, error)
+	// NewProducer returns the producer for derived metrics, a
+	// sarama.AsyncProducer is used if unset
+	NewProducer func(brokers []string, conf *sarama.Config) (sarama.AsyncProducer, error)
 	// unexported
 	delay    *delay.Delay
-	deriver  map[string]intf.Deriver
+	inflight *delay.Delay
+	deriver  map[string][]intf.Deriver
+	enabled  map[string]intf.Deriver
+	refs     map[*erebos.Transport]int
 	trackID  map[string]int
 	trackACK map[string][]*erebos.Transport
+	retry    []retryBatch
+	held     int
 	dispatch chan<- *sarama.ProducerMessage
 	producer sarama.AsyncProducer
-	lookup   *wall.Lookup
 }
 
 // updateOffset updates the consumer offsets in Kafka once all
@@ -73,12 +98,41 @@ func (h *Hurricane) updateOffset(trackingID string) {
 	}
 }
 
-// commit marks a message as fully processed
+// release returns the transports of acks that are no longer held by
+// any deriver. Transports that were fanned out to multiple derivers
+// are only returned once the last deriver released them.
+func (h *Hurricane) release(acks []*erebos.Transport) []*erebos.Transport {
+	released := []*erebos.Transport{}
+	for _, t := range acks {
+		if _, ok := h.refs[t]; ok {
+			h.refs[t]--
+			if h.refs[t] > 0 {
+				continue
+			}
+			delete(h.refs, t)
+		}
+		released = append(released, t)
+	}
+	return released
+}
+
+// commit marks a message as fully processed. The consumer offset is
+// only advanced once all earlier offsets of the partition have been
+// processed as well.
 func (h *Hurricane) commit(msg *erebos.Transport) {
+	offset, ok := tracker.processed(msg)
+	metrics.GetOrRegisterGauge(
+		`/commit/uncommitted.gap`,
+		*h.Metrics,
+	).Update(tracker.gap())
+	if !ok {
+		return
+	}
+
 	msg.Commit <- &erebos.Commit{
 		Topic:     msg.Topic,
 		Partition: msg.Partition,
-		Offset:    msg.Offset,
+		Offset:    offset,
 	}
 }
 
@@ -0,0 +1,103 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package hurricane // import "github.com/solnx/hurricane/internal/hurricane"
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+	uuid "github.com/satori/go.uuid"
+	"github.com/solnx/hurricane/internal/deadletter"
+)
+
+// deadLetter writes msg, rejected for reasons, to the dead letter
+// spool and produces it to the dead letter topic if they are
+// configured. The acks are committed once the dead letter has been
+// written.
+func (h *Hurricane) deadLetter(msg *erebos.Transport, reasons []string, acks []*erebos.Transport) {
+	letter := deadletter.New(msg, reasons...)
+
+	if h.Spool != nil {
+		if err := h.Spool.Write(letter); err != nil {
+			logrus.Errorf("Handler #%d: could not spool dead letter: %s",
+				h.Num, err.Error())
+			metrics.GetOrRegisterCounter(
+				`/deadletter/errors`,
+				*h.Metrics,
+			).Inc(1)
+		}
+	}
+
+	if topic := h.deadLetterTopic(); topic != `` {
+		data, err := json.Marshal(letter)
+		if err == nil {
+			trackingID := uuid.Must(uuid.NewV4()).String()
+			h.inflight.Use()
+			go func() {
+				h.dispatch <- &sarama.ProducerMessage{
+					Topic:    topic,
+					Key:      sarama.StringEncoder(letter.Reason),
+					Value:    sarama.ByteEncoder(data),
+					Headers:  headers(letter),
+					Metadata: trackingID,
+				}
+				h.inflight.Done()
+			}()
+			// store ACKs until AsyncProducer returns success
+			h.trackID[trackingID] = 1
+			h.trackACK[trackingID] = acks
+			return
+		}
+		logrus.Errorf("Handler #%d: could not encode dead letter: %s",
+			h.Num, err.Error())
+		metrics.GetOrRegisterCounter(
+			`/deadletter/errors`,
+			*h.Metrics,
+		).Inc(1)
+	}
+
+	for i := range acks {
+		h.delay.Use()
+		go func(idx int) {
+			h.commit(acks[idx])
+			h.delay.Done()
+		}(i)
+	}
+}
+
+// headers returns the record headers of the dead letter l, they allow
+// to filter dead letters without decoding them
+func headers(l *deadletter.Letter) []sarama.RecordHeader {
+	return []sarama.RecordHeader{
+		{Key: []byte(`reason`), Value: []byte(l.Reason)},
+		{Key: []byte(`topic`), Value: []byte(l.Topic)},
+		{Key: []byte(`partition`), Value: []byte(
+			strconv.Itoa(int(l.Partition)))},
+		{Key: []byte(`offset`), Value: []byte(
+			strconv.FormatInt(l.Offset, 10))},
+		{Key: []byte(`timestamp`), Value: []byte(
+			l.Timestamp.Format(time.RFC3339Nano))},
+	}
+}
+
+// deadLetterTopic returns the dead letter topic, dead letters are not
+// produced if it is empty
+func (h *Hurricane) deadLetterTopic() string {
+	if h.Settings == nil {
+		return ``
+	}
+	return h.Settings.Hurricane.DeadLetterTopic
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
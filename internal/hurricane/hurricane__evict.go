@@ -0,0 +1,62 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package hurricane // import "github.com/solnx/hurricane/internal/hurricane"
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/hurricane/internal/intf"
+)
+
+// evictInterval is the interval in which derivers are swept for idle
+// state
+const evictInterval = time.Minute
+
+// evict removes idle state from all enabled derivers that have an
+// idle TTL configured. Outstanding acknowledgements of the removed
+// state are committed, since the state will never be completed.
+func (h *Hurricane) evict() {
+	now := time.Now()
+	for name := range h.enabled {
+		e, ok := h.enabled[name].(intf.Evictor)
+		if !ok {
+			continue
+		}
+		ttl := h.Settings.Deriver(name).IdleTTL
+		if ttl <= 0 {
+			continue
+		}
+
+		acks, evicted := e.Evict(now.Add(
+			-time.Duration(ttl) * time.Second,
+		))
+		metrics.GetOrRegisterCounter(
+			fmt.Sprintf("/deriver/%s/evicted", name),
+			*h.Metrics,
+		).Inc(int64(evicted))
+		if evicted > 0 {
+			logrus.Debugf("Handler #%d: evicted %d idle entries from %s",
+				h.Num, evicted, name)
+		}
+
+		acks = h.release(acks)
+		for i := range acks {
+			h.delay.Use()
+			go func(idx int) {
+				h.commit(acks[idx])
+				h.delay.Done()
+			}(i)
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,59 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package hurricane // import "github.com/solnx/hurricane/internal/hurricane"
+
+import (
+	"fmt"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/hurricane/internal/intf"
+)
+
+// expire gives up on incomplete distributions of all enabled derivers
+// that have a completion timeout configured. Depending on the
+// configured policy, they are either dropped or partially evaluated.
+// In both cases their outstanding acknowledgements are released.
+func (h *Hurricane) expire() {
+	now := time.Now()
+	for name := range h.enabled {
+		e, ok := h.enabled[name].(intf.Expirer)
+		if !ok {
+			continue
+		}
+		settings := h.Settings.Deriver(name)
+		if settings.CompletionTimeout <= 0 {
+			continue
+		}
+
+		derived, acks, dropped, evaluated, err := e.Expire(
+			now.Add(-time.Duration(settings.CompletionTimeout)*time.Second),
+			settings.IncompletePolicy == `partial`,
+		)
+		if err != nil {
+			// error from the eyewall lookup
+			h.Death <- err
+			<-h.Shutdown
+			return
+		}
+
+		metrics.GetOrRegisterCounter(
+			fmt.Sprintf("/deriver/%s/incomplete.dropped", name),
+			*h.Metrics,
+		).Inc(int64(dropped))
+		metrics.GetOrRegisterCounter(
+			fmt.Sprintf("/deriver/%s/incomplete.evaluated", name),
+			*h.Metrics,
+		).Inc(int64(evaluated))
+
+		h.produce(derived, h.release(acks))
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
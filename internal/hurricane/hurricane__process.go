@@ -16,30 +16,36 @@ import (
 	"github.com/Shopify/sarama"
 	"github.com/Sirupsen/logrus"
 	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
 	uuid "github.com/satori/go.uuid"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/numeric"
 	"github.com/solnx/legacy"
 )
 
 // process is the handler for deriving metrics and producing the
-// result. Invalid data is marked as processed and skipped.
+// result. Invalid data is marked as processed, counted as discarded
+// and skipped.
 func (h *Hurricane) process(msg *erebos.Transport) {
 	if msg == nil || msg.Value == nil {
 		logrus.Warnf("Ignoring empty message from: %d", msg.HostID)
 		if msg != nil {
-			h.delay.Use()
-			go func() {
-				h.commit(msg)
-				h.delay.Done()
-			}()
+			h.discard(msg, `empty`)
 		}
 		return
 	}
 
+	// message rejected by Dispatch
+	if msg.HostID == unroutable {
+		h.discard(msg, `hostid`)
+		return
+	}
+
 	// handle heartbeat messages
 	if erebos.IsHeartbeat(msg) {
 		h.delay.Use()
 		go func() {
-			h.lookup.Heartbeat(func() string {
+			h.Lookup.Heartbeat(func() string {
 				switch h.Config.Misc.InstanceName {
 				case ``:
 					return `hurricane`
@@ -50,12 +56,21 @@ func (h *Hurricane) process(msg *erebos.Transport) {
 			}(), h.Num, msg.Value)
 			h.delay.Done()
 		}()
+		// give up on distributions that are not being completed
+		h.expire()
 		return
 	}
 
 	m := &legacy.MetricSplit{}
 	if err := json.Unmarshal(msg.Value, m); err != nil {
 		logrus.Warnf("Ignoring invalid data: %s", err.Error())
+		h.discard(msg, `invalid`)
+		return
+	}
+
+	derivers, ok := h.deriver[m.Path]
+	if !ok {
+		// no Deriver interested in this metric
 		h.delay.Use()
 		go func() {
 			h.commit(msg)
@@ -64,63 +79,193 @@ func (h *Hurricane) process(msg *erebos.Transport) {
 		return
 	}
 
-	if _, ok := h.deriver[m.Path]; !ok {
-		// no Deriver interested in this metric
+	// msg is acknowledged once all derivers have released it
+	if len(derivers) > 1 {
+		h.refs[msg] = len(derivers)
+	}
+	// msg is written as a single dead letter, even if several derivers
+	// rejected it
+	reasons := []string{}
+	for _, d := range derivers {
+		derived, acks, ok, err := h.update(d, m, msg)
+		switch e := err.(type) {
+		case nil:
+			if ok {
+				h.produce(derived, h.release(acks))
+			}
+		case *numeric.Error:
+			logrus.Warnf("Ignoring invalid value: %s", e.Error())
+			reasons = append(reasons, e.Reason)
+		case *poisonError:
+			h.drop(d, m.AssetID, msg)
+			reasons = append(reasons, `panic`)
+		default:
+			// error from the eyewall lookup
+			h.Death <- err
+			<-h.Shutdown
+			return
+		}
+	}
+	if len(reasons) > 0 {
+		h.discard(msg, reasons...)
+	}
+}
+
+// poisonError is returned by update if the deriver panicked
+type poisonError struct {
+	cause interface{}
+}
+
+// Error implements the error interface
+func (e *poisonError) Error() string {
+	return fmt.Sprintf("deriver panic: %v", e.cause)
+}
+
+// update passes m to deriver d. If d panics, the panic is recovered
+// and msg is logged as poison message.
+func (h *Hurricane) update(d intf.Deriver, m *legacy.MetricSplit, msg *erebos.Transport) (derived []*legacy.MetricSplit, acks []*erebos.Transport, ok bool, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("Handler #%d: deriver %T panicked on %s/%d/%d: %v: %s",
+				h.Num, d, msg.Topic, msg.Partition, msg.Offset, r,
+				string(msg.Value))
+			derived, acks, ok = nil, nil, false
+			err = &poisonError{cause: r}
+		}
+	}()
+	return d.Update(m, msg)
+}
+
+// drop removes the state of assetID from deriver d after d panicked
+// on msg, since the state may be inconsistent. The acknowledgements
+// held by the state are committed, except for msg. d holds msg no
+// longer and it is released once by discard, like for any other
+// deriver that rejected it.
+func (h *Hurricane) drop(d intf.Deriver, assetID int64, msg *erebos.Transport) {
+	dropper, ok := d.(intf.Dropper)
+	if !ok {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			logrus.Errorf("Handler #%d: deriver %T panicked dropping asset %d: %v",
+				h.Num, d, assetID, r)
+		}
+	}()
+
+	held := []*erebos.Transport{}
+	for _, t := range dropper.Drop(assetID) {
+		if t != msg && !holds(held, t) {
+			held = append(held, t)
+		}
+	}
+	acks := h.release(held)
+	for i := range acks {
 		h.delay.Use()
-		go func() {
-			h.commit(msg)
+		go func(idx int) {
+			h.commit(acks[idx])
 			h.delay.Done()
-		}()
+		}(i)
+	}
+}
+
+// holds checks if t is one of acks
+func holds(acks []*erebos.Transport, t *erebos.Transport) bool {
+	for i := range acks {
+		if acks[i] == t {
+			return true
+		}
+	}
+	return false
+}
+
+// discard drops msg, rejected once for each of reasons, counts it in
+// the discard counter of each distinct reason and writes it as dead
+// letter. msg is committed once no deriver holds it anymore.
+func (h *Hurricane) discard(msg *erebos.Transport, reasons ...string) {
+	acks := []*erebos.Transport{}
+	distinct := []string{}
+	for _, reason := range reasons {
+		// every rejecting deriver no longer holds msg
+		acks = append(acks, h.release([]*erebos.Transport{msg})...)
+		if contains(distinct, reason) {
+			continue
+		}
+		distinct = append(distinct, reason)
+		metrics.GetOrRegisterCounter(
+			fmt.Sprintf("/discard/%s", reason),
+			*h.Metrics,
+		).Inc(1)
+	}
+
+	h.deadLetter(msg, distinct, acks)
+}
+
+// contains checks if s is one of list
+func contains(list []string, s string) bool {
+	for i := range list {
+		if list[i] == s {
+			return true
+		}
+	}
+	return false
+}
+
+// produce sends the derived metrics to Kafka. The acks are committed
+// once all derived metrics have been successfully produced. While the
+// tag lookup is degraded, the retry policy holds the derived metrics
+// instead.
+func (h *Hurricane) produce(derived []*legacy.MetricSplit, acks []*erebos.Transport) {
+	if h.hold(derived, acks) {
 		return
 	}
+	h.send(derived, acks)
+}
 
-	if derived, acks, ok, err := h.deriver[m.Path].Update(m, msg); ok {
-		trackingID := uuid.Must(uuid.NewV4()).String()
-		var produced int
+// send produces derived to Kafka and tracks acks until all derived
+// metrics have been produced
+func (h *Hurricane) send(derived []*legacy.MetricSplit, acks []*erebos.Transport) {
+	trackingID := uuid.Must(uuid.NewV4()).String()
+	var produced int
+
+	for i := range derived {
+		data, e := json.Marshal(&derived[i])
+		if e != nil {
+			logrus.Warnf("Ignoring invalid data: %s",
+				e.Error())
+			logrus.Debugln(`Ignored data:`, derived[i])
+			continue
+		}
 
-		for i := range derived {
-			data, e := json.Marshal(&derived[i])
-			if e != nil {
-				logrus.Warnf("Ignoring invalid data: %s",
-					e.Error())
-				logrus.Debugln(`Ignored data:`, derived[i])
-				continue
+		h.inflight.Use()
+		go func(idx int, data []byte) {
+			h.dispatch <- &sarama.ProducerMessage{
+				Topic: h.Config.Kafka.ProducerTopic,
+				Key: sarama.StringEncoder(
+					strconv.Itoa(int(derived[idx].AssetID)),
+				),
+				Value:    sarama.ByteEncoder(data),
+				Metadata: trackingID,
 			}
+			h.inflight.Done()
+		}(i, data)
+		produced++
+	}
 
+	// if no metrics were produced, commit ACKs immediately
+	if produced == 0 {
+		for i := range acks {
 			h.delay.Use()
-			go func(idx int, data []byte) {
-				h.dispatch <- &sarama.ProducerMessage{
-					Topic: h.Config.Kafka.ProducerTopic,
-					Key: sarama.StringEncoder(
-						strconv.Itoa(int(derived[idx].AssetID)),
-					),
-					Value:    sarama.ByteEncoder(data),
-					Metadata: trackingID,
-				}
+			go func(idx int) {
+				h.commit(acks[idx])
 				h.delay.Done()
-			}(i, data)
-			produced++
+			}(i)
 		}
-
-		// if no metrics were produced, commit ACKs immediately
-		if produced == 0 {
-			for i := range acks {
-				h.delay.Use()
-				go func(idx int) {
-					h.commit(acks[idx])
-					h.delay.Done()
-				}(i)
-			}
-			return
-		}
-		// store ACKs until AsyncProducer returns success
-		h.trackID[trackingID] = produced
-		h.trackACK[trackingID] = acks
-	} else if err != nil {
-		// error from the eyewall lookup
-		h.Death <- err
-		<-h.Shutdown
+		return
 	}
+	// store ACKs until AsyncProducer returns success
+	h.trackID[trackingID] = produced
+	h.trackACK[trackingID] = acks
 }
 
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,111 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package hurricane // import "github.com/solnx/hurricane/internal/hurricane"
+
+import (
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/lookup"
+	"github.com/solnx/legacy"
+)
+
+// defaultRetryBuffer is the number of derived metrics a handler holds
+// for the retry policy if no size is configured
+const defaultRetryBuffer = 16384
+
+// retryBatch is a set of derived metrics held while the tag lookup is
+// degraded, together with the acks to commit once they are produced
+type retryBatch struct {
+	derived []*legacy.MetricSplit
+	acks    []*erebos.Transport
+}
+
+// hold stores derived and acks in the retry buffer if the lookup
+// failure policy is retry and the tag lookup is degraded. If the
+// buffer is full, the oldest batches are produced untagged. It
+// returns true if derived is held.
+func (h *Hurricane) hold(derived []*legacy.MetricSplit, acks []*erebos.Transport) bool {
+	if len(derived) == 0 || h.Settings == nil ||
+		lookup.Policy(h.Settings.Hurricane.LookupFailurePolicy) != lookup.PolicyRetry {
+		return false
+	}
+	if d, ok := h.Lookup.(intf.Degrader); !ok || !d.Degraded() {
+		// keep the order of derived metrics
+		if len(h.retry) == 0 {
+			return false
+		}
+	}
+
+	h.retry = append(h.retry, retryBatch{derived: derived, acks: acks})
+	h.held += len(derived)
+
+	limit := h.Settings.Hurricane.LookupRetryBuffer
+	if limit <= 0 {
+		limit = defaultRetryBuffer
+	}
+	for h.held > limit && len(h.retry) > 1 {
+		metrics.GetOrRegisterCounter(
+			`/lookup/retry.overflow`, *h.Metrics,
+		).Inc(int64(len(h.retry[0].derived)))
+		h.pop()
+	}
+	h.updateHeld()
+	return true
+}
+
+// resend tags and produces the held derived metrics once the tag
+// lookup has recovered
+func (h *Hurricane) resend() {
+	for len(h.retry) > 0 {
+		if err := intf.LookupTags(h.Lookup, h.retry[0].derived); err != nil {
+			logrus.Warnf("Handler #%d: retry of held metrics failed: %s",
+				h.Num, err.Error())
+			break
+		}
+		if d, ok := h.Lookup.(intf.Degrader); ok && d.Degraded() {
+			break
+		}
+		h.pop()
+	}
+	h.updateHeld()
+}
+
+// flush produces all held derived metrics with the tags they have
+func (h *Hurricane) flush() {
+	if len(h.retry) > 0 {
+		logrus.Warnf("Handler #%d: producing %d held metrics without"+
+			" retrying their tags", h.Num, h.held)
+	}
+	for len(h.retry) > 0 {
+		h.pop()
+	}
+	h.updateHeld()
+}
+
+// pop produces the oldest held batch
+func (h *Hurricane) pop() {
+	b := h.retry[0]
+	h.retry = h.retry[1:]
+	h.held -= len(b.derived)
+	h.send(b.derived, b.acks)
+}
+
+// updateHeld exports the number of held derived metrics
+func (h *Hurricane) updateHeld() {
+	metrics.GetOrRegisterGauge(
+		fmt.Sprintf("/handler/%d/lookup.retry.held", h.Num),
+		*h.Metrics,
+	).Update(int64(h.held))
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
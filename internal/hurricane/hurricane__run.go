@@ -9,6 +9,8 @@
 package hurricane // import "github.com/solnx/hurricane/internal/hurricane"
 
 import (
+	"time"
+
 	"github.com/Sirupsen/logrus"
 	metrics "github.com/rcrowley/go-metrics"
 )
@@ -28,7 +30,17 @@ func (h *Hurricane) run() {
 	inputEmpty := false
 	errorEmpty := false
 	successEmpty := false
-	producerClosed := false
+	flushed := false
+	// closed once all derived metrics have been handed to the producer
+	var dispatched chan struct{}
+
+	// periodically sweep the derivers for idle state
+	evict := time.NewTicker(evictInterval)
+	defer evict.Stop()
+
+	// periodically call time driven derivers
+	tick := time.NewTicker(h.tickInterval())
+	defer tick.Stop()
 
 runloop:
 	for {
@@ -53,9 +65,14 @@ runloop:
 			}
 			h.process(msg)
 			in.Mark(1)
+		case <-evict.C:
+			h.evict()
+		case now := <-tick.C:
+			h.tick(now)
 		}
 	}
 	// shutdown due to producer error
+	h.inflight.Wait()
 	h.producer.Close()
 	return
 
@@ -67,9 +84,18 @@ drainloop:
 				// channel is closed
 				inputEmpty = true
 
-				if !producerClosed {
-					h.producer.Close()
-					producerClosed = true
+				if !flushed {
+					// produce held metrics with the tags they have
+					h.flush()
+					flushed = true
+
+					// the producer can only be closed once no
+					// more metrics are sent to its input channel
+					dispatched = make(chan struct{})
+					go func() {
+						h.inflight.Wait()
+						close(dispatched)
+					}()
 				}
 
 				// channels are closed
@@ -79,6 +105,9 @@ drainloop:
 				continue drainloop
 			}
 			h.process(msg)
+		case <-dispatched:
+			h.producer.Close()
+			dispatched = nil
 		case e := <-h.producer.Errors():
 			if e == nil {
 				errorEmpty = true
@@ -106,6 +135,12 @@ drainloop:
 		}
 	}
 	h.delay.Wait()
+
+	// all input has been processed, persist the deriver state
+	if err := h.persist(); err != nil {
+		logrus.Errorf("Handler #%d: could not write state: %s",
+			h.Num, err.Error())
+	}
 }
 
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
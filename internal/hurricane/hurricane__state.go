@@ -0,0 +1,118 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package hurricane // import "github.com/solnx/hurricane/internal/hurricane"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/solnx/hurricane/internal/intf"
+)
+
+// snapshot is the on-disk format of the handler state
+type snapshot struct {
+	Derivers map[string]json.RawMessage `json:"derivers"`
+}
+
+// stateFile returns the location of the state snapshot for h. An
+// empty string is returned if snapshots are disabled.
+func (h *Hurricane) stateFile() string {
+	if h.Settings == nil || h.Settings.Hurricane.StateDirectory == `` {
+		return ``
+	}
+	return filepath.Join(
+		h.Settings.Hurricane.StateDirectory,
+		fmt.Sprintf("handler.%d.state", h.Num),
+	)
+}
+
+// restore loads the deriver state snapshot written during the last
+// shutdown. The snapshot is removed after it has been read, so that
+// it is not restored again after an unclean shutdown.
+func (h *Hurricane) restore() error {
+	fname := h.stateFile()
+	if fname == `` {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = os.Remove(fname); err != nil {
+		return err
+	}
+
+	s := snapshot{}
+	if err = json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	for name := range s.Derivers {
+		d, ok := h.enabled[name].(intf.Stateful)
+		if !ok {
+			logrus.Warnf("Handler #%d: discarding state for deriver %s",
+				h.Num, name)
+			continue
+		}
+		if err = d.Restore(s.Derivers[name]); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Handler #%d: restored state from %s", h.Num, fname)
+	return nil
+}
+
+// persist writes the state of all enabled derivers to disk. It must
+// only be called after the handler has stopped processing messages.
+func (h *Hurricane) persist() error {
+	fname := h.stateFile()
+	if fname == `` {
+		return nil
+	}
+
+	s := snapshot{
+		Derivers: make(map[string]json.RawMessage),
+	}
+	for name := range h.enabled {
+		d, ok := h.enabled[name].(intf.Stateful)
+		if !ok {
+			continue
+		}
+		data, err := d.Snapshot()
+		if err != nil {
+			return err
+		}
+		s.Derivers[name] = data
+	}
+
+	data, err := json.Marshal(&s)
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so an interrupted write can
+	// not leave a truncated snapshot behind
+	tmp := fname + `.tmp`
+	if err = ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, fname); err != nil {
+		return err
+	}
+	logrus.Infof("Handler #%d: wrote state to %s", h.Num, fname)
+	return nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,53 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package hurricane // import "github.com/solnx/hurricane/internal/hurricane"
+
+import (
+	"time"
+
+	"github.com/solnx/hurricane/internal/intf"
+)
+
+// defaultTickInterval is the interval in which time driven derivers
+// are called if no interval is configured
+const defaultTickInterval = 10 * time.Second
+
+// tickInterval returns the configured interval for time driven
+// derivers
+func (h *Hurricane) tickInterval() time.Duration {
+	if h.Settings == nil || h.Settings.Hurricane.TickInterval <= 0 {
+		return defaultTickInterval
+	}
+	return time.Duration(h.Settings.Hurricane.TickInterval) * time.Second
+}
+
+// tick calls all enabled derivers that implement intf.Ticker and
+// produces their derived metrics. Held derived metrics are retried
+// first.
+func (h *Hurricane) tick(now time.Time) {
+	h.resend()
+
+	for name := range h.enabled {
+		t, ok := h.enabled[name].(intf.Ticker)
+		if !ok {
+			continue
+		}
+
+		if derived, acks, ok, err := t.Tick(now); ok {
+			h.produce(derived, h.release(acks))
+		} else if err != nil {
+			// error from the eyewall lookup
+			h.Death <- err
+			<-h.Shutdown
+			return
+		}
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,507 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package hurricane // import "github.com/solnx/hurricane/internal/hurricane"
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/mjolnir42/erebos"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/solnx/hurricane/internal/config"
+	"github.com/solnx/hurricane/internal/deadletter"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/lookup"
+	"github.com/solnx/hurricane/internal/registry"
+	"github.com/solnx/legacy"
+
+	// the pipeline tests derive metrics with the ctx deriver, and
+	// with a rule on the same input for the fan out
+	_ "github.com/solnx/hurricane/internal/ctx"
+	_ "github.com/solnx/hurricane/internal/rule"
+)
+
+// timeout is the time a test waits for the pipeline
+const timeout = 5 * time.Second
+
+func init() {
+	registry.Register(`poison`, func(*erebos.Config, *config.Config, intf.TagLookup) (intf.Deriver, error) {
+		return &holder{held: make(map[int64][]*erebos.Transport), poison: true}, nil
+	})
+	registry.Register(`holder`, func(*erebos.Config, *config.Config, intf.TagLookup) (intf.Deriver, error) {
+		return &holder{held: make(map[int64][]*erebos.Transport)}, nil
+	})
+}
+
+// holder is a test deriver for /test/hold that holds every message
+// until minute 2. The poison holder instead panics on minute 0 after
+// holding the message, and releases everything it holds on every
+// later minute.
+type holder struct {
+	held   map[int64][]*erebos.Transport
+	poison bool
+}
+
+func (d *holder) Register(m map[string]intf.Deriver) { m[`/test/hold`] = d }
+func (d *holder) Start() error                       { return nil }
+func (d *holder) Close()                             {}
+
+func (d *holder) Update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	d.held[m.AssetID] = append(d.held[m.AssetID], t)
+	switch {
+	case d.poison && m.TS.Minute() == 0:
+		panic(`poison`)
+	case d.poison || m.TS.Minute() == 2:
+		acks := d.held[m.AssetID]
+		delete(d.held, m.AssetID)
+		return nil, acks, true, nil
+	}
+	return nil, nil, false, nil
+}
+
+func (d *holder) Drop(assetID int64) []*erebos.Transport {
+	acks := d.held[assetID]
+	delete(d.held, assetID)
+	return acks
+}
+
+// pipeline runs a handler against a mock producer
+type pipeline struct {
+	t        *testing.T
+	h        *Hurricane
+	topic    string
+	commits  chan *erebos.Commit
+	done     chan struct{}
+	handlers map[int]erebos.Handler
+}
+
+// newPipeline returns a pipeline consuming from topic. The
+// expectations for the mock producer are set by expect.
+func newPipeline(t *testing.T, topic string, expect func(*mocks.AsyncProducer)) *pipeline {
+	settings := &config.Config{}
+	settings.Hurricane.EnabledDerivers = []string{`ctx`}
+	conf := &erebos.Config{}
+	conf.Kafka.ProducerTopic = `derived`
+	registry := metrics.NewRegistry()
+
+	p := &pipeline{
+		t:        t,
+		topic:    topic,
+		commits:  make(chan *erebos.Commit, 16),
+		done:     make(chan struct{}),
+		handlers: Handlers,
+	}
+	p.h = &Hurricane{
+		Num:      0,
+		Input:    make(chan *erebos.Transport, 16),
+		Shutdown: make(chan struct{}),
+		Death:    make(chan error),
+		Config:   conf,
+		Metrics:  &registry,
+		Settings: settings,
+		Lookup:   lookup.NewMemory(),
+		Brokers: func(*erebos.Config) ([]string, error) {
+			return []string{`localhost:9092`}, nil
+		},
+		NewProducer: func(brokers []string, c *sarama.Config) (sarama.AsyncProducer, error) {
+			producer := mocks.NewAsyncProducer(t, c)
+			expect(producer)
+			return producer, nil
+		},
+	}
+
+	// route the messages of all hosts to the pipeline
+	Handlers = make(map[int]erebos.Handler)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		Handlers[i] = p.h
+	}
+	return p
+}
+
+// start runs the handler
+func (p *pipeline) start() {
+	go func() {
+		p.h.Start()
+		close(p.done)
+	}()
+}
+
+// stop shuts the handler down the same way main does and waits for it
+// to finish
+func (p *pipeline) stop() {
+	close(p.h.Shutdown)
+	close(p.h.Input)
+	p.wait()
+}
+
+// wait waits for the handler to finish and restores the registered
+// handlers
+func (p *pipeline) wait() {
+	select {
+	case <-p.done:
+	case <-time.After(timeout):
+		p.t.Fatal(`handler did not shut down`)
+	}
+	Handlers = p.handlers
+}
+
+// send dispatches the metric path with value v for minute min at
+// offset
+func (p *pipeline) send(offset int64, path string, min int, v int64) {
+	p.dispatch(offset, fmt.Sprintf(
+		`[1, "%s", "2017-06-01T10:%02d:00Z", "integer", "", %d, [], null]`,
+		path, min, v))
+}
+
+// dispatch dispatches the raw message value at offset
+func (p *pipeline) dispatch(offset int64, value string) {
+	err := Dispatch(erebos.Transport{
+		Value:     []byte(value),
+		Topic:     p.topic,
+		Partition: 0,
+		Offset:    offset,
+		Commit:    p.commits,
+	})
+	if err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// committed waits until offset is committed. Commits must not go
+// beyond offset.
+func (p *pipeline) committed(offset int64) {
+	for {
+		select {
+		case c := <-p.commits:
+			if c.Topic != p.topic || c.Partition != 0 {
+				p.t.Fatalf("commit for %s/%d, expected %s/0",
+					c.Topic, c.Partition, p.topic)
+			}
+			if c.Offset > offset {
+				p.t.Fatalf("committed offset %d, expected %d",
+					c.Offset, offset)
+			}
+			if c.Offset == offset {
+				return
+			}
+		case <-time.After(timeout):
+			p.t.Fatalf("offset %d was not committed", offset)
+		}
+	}
+}
+
+// uncommitted fails if any offset has been committed
+func (p *pipeline) uncommitted() {
+	select {
+	case c := <-p.commits:
+		p.t.Errorf("unexpected commit of offset %d", c.Offset)
+	default:
+	}
+}
+
+// derived checks that a produced message is a context switch rate
+func derived(msg *sarama.ProducerMessage) error {
+	data, err := msg.Value.Encode()
+	if err != nil {
+		return err
+	}
+	m := &legacy.MetricSplit{}
+	if err = json.Unmarshal(data, m); err != nil {
+		return err
+	}
+	if msg.Topic != `derived` || m.Path != `ctx.per.second` {
+		return fmt.Errorf("unexpected metric %s on topic %s",
+			m.Path, msg.Topic)
+	}
+	return nil
+}
+
+// TestPipeline produces derived metrics and commits the offsets of
+// their input once they are produced
+func TestPipeline(t *testing.T) {
+	p := newPipeline(t, `pipeline`, func(producer *mocks.AsyncProducer) {
+		producer.ExpectInputWithMessageCheckerFunctionAndSucceed(derived)
+		producer.ExpectInputWithMessageCheckerFunctionAndSucceed(derived)
+	})
+	p.start()
+
+	// the first value only initializes the deriver, no deriver is
+	// registered for the second metric
+	p.send(0, `/sys/cpu/ctx`, 0, 100000)
+	p.send(1, `/sys/memory/free`, 0, 1024)
+	p.send(2, `/sys/cpu/ctx`, 1, 160000)
+	p.committed(2)
+
+	p.send(3, `/sys/cpu/ctx`, 2, 190000)
+	p.committed(3)
+
+	p.stop()
+	p.uncommitted()
+}
+
+// TestPipelineDiscard commits and counts messages whose value the
+// deriver rejects
+func TestPipelineDiscard(t *testing.T) {
+	p := newPipeline(t, `discard`, func(producer *mocks.AsyncProducer) {
+		producer.ExpectInputWithMessageCheckerFunctionAndSucceed(derived)
+	})
+	p.start()
+
+	p.send(0, `/sys/cpu/ctx`, 0, 100000)
+	p.dispatch(1, `[1, "/sys/cpu/ctx", "2017-06-01T10:01:00Z", "string", "", "NaN", [], null]`)
+	p.dispatch(2, `[1, "/sys/cpu/ctx", "2017-06-01T10:01:00Z", "real", "", 160000.0, [], null]`)
+	p.committed(2)
+	p.stop()
+
+	discarded := metrics.GetOrRegisterCounter(`/discard/nan`,
+		*p.h.Metrics).Count()
+	if discarded != 1 {
+		t.Errorf("discarded %d NaN values, expected 1", discarded)
+	}
+}
+
+// TestPipelineDeadLetter writes rejected messages as dead letters and
+// commits their offsets once the dead letter is produced
+func TestPipelineDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir(``, `hurricane`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spool, err := deadletter.OpenSpool(filepath.Join(dir, `spool`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	letter := func(msg *sarama.ProducerMessage) error {
+		data, err := msg.Value.Encode()
+		if err != nil {
+			return err
+		}
+		l := &deadletter.Letter{}
+		if err = json.Unmarshal(data, l); err != nil {
+			return err
+		}
+		if msg.Topic != `rejected` || l.Reason != `invalid` ||
+			l.Topic != `deadletter` || l.Offset != 0 ||
+			l.Payload != `{"broken` {
+			return fmt.Errorf("unexpected dead letter %s on topic %s",
+				data, msg.Topic)
+		}
+		return checkHeaders(msg, map[string]string{
+			`reason`:    `invalid`,
+			`topic`:     `deadletter`,
+			`partition`: `0`,
+			`offset`:    `0`,
+			`timestamp`: l.Timestamp.Format(time.RFC3339Nano),
+		})
+	}
+	p := newPipeline(t, `deadletter`, func(producer *mocks.AsyncProducer) {
+		producer.ExpectInputWithMessageCheckerFunctionAndSucceed(letter)
+	})
+	p.h.Settings.Hurricane.DeadLetterTopic = `rejected`
+	p.h.Spool = spool
+	p.start()
+
+	p.dispatch(0, `{"broken`)
+	p.committed(0)
+	p.stop()
+
+	if err = spool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, `spool`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &deadletter.Letter{}
+	if err = json.Unmarshal(data, l); err != nil {
+		t.Fatal(err)
+	}
+	if l.Reason != `invalid` || l.Payload != `{"broken` {
+		t.Errorf("unexpected spooled dead letter %s", data)
+	}
+}
+
+// TestPipelineDeadLetterFanOut writes a single dead letter for a
+// message that several derivers reject
+func TestPipelineDeadLetterFanOut(t *testing.T) {
+	letter := func(msg *sarama.ProducerMessage) error {
+		data, err := msg.Value.Encode()
+		if err != nil {
+			return err
+		}
+		l := &deadletter.Letter{}
+		if err = json.Unmarshal(data, l); err != nil {
+			return err
+		}
+		if l.Reason != `nan` || l.Offset != 1 {
+			return fmt.Errorf("unexpected dead letter %s", data)
+		}
+		return checkHeaders(msg, map[string]string{
+			`reason`: `nan`,
+			`offset`: `1`,
+		})
+	}
+	p := newPipeline(t, `fanout`, func(producer *mocks.AsyncProducer) {
+		producer.ExpectInputWithMessageCheckerFunctionAndSucceed(letter)
+	})
+	p.h.Settings.Hurricane.EnabledDerivers = []string{`ctx`, `rule`}
+	p.h.Settings.Hurricane.Rules = []config.Rule{{
+		Name:      `ctx`,
+		Inputs:    []string{`/sys/cpu/ctx`},
+		Operation: `delta`,
+		Path:      `ctx.delta`,
+	}}
+	p.h.Settings.Hurricane.DeadLetterTopic = `rejected`
+	p.start()
+
+	p.send(0, `/sys/cpu/ctx`, 0, 100000)
+	p.dispatch(1, `[1, "/sys/cpu/ctx", "2017-06-01T10:01:00Z", "string", "", "NaN", [], null]`)
+	p.stop()
+
+	discarded := metrics.GetOrRegisterCounter(`/discard/nan`,
+		*p.h.Metrics).Count()
+	if discarded != 1 {
+		t.Errorf("discarded %d NaN values, expected 1", discarded)
+	}
+}
+
+// TestPipelinePanic does not release a message twice if a deriver
+// panics after holding it, the message stays uncommitted while
+// another deriver holds it
+func TestPipelinePanic(t *testing.T) {
+	p := newPipeline(t, `panic`, func(*mocks.AsyncProducer) {})
+	p.h.Settings.Hurricane.EnabledDerivers = []string{`holder`, `poison`}
+	p.start()
+
+	p.send(0, `/test/hold`, 0, 1)
+	p.send(1, `/test/hold`, 1, 1)
+	time.Sleep(100 * time.Millisecond)
+	p.uncommitted()
+
+	p.send(2, `/test/hold`, 2, 1)
+	p.committed(2)
+	p.stop()
+	p.uncommitted()
+
+	panicked := metrics.GetOrRegisterCounter(`/discard/panic`,
+		*p.h.Metrics).Count()
+	if panicked != 1 {
+		t.Errorf("discarded %d messages after a panic, expected 1",
+			panicked)
+	}
+}
+
+// checkHeaders checks that the record headers of msg carry the
+// values in expected
+func checkHeaders(msg *sarama.ProducerMessage, expected map[string]string) error {
+	headers := make(map[string]string, len(msg.Headers))
+	for _, h := range msg.Headers {
+		headers[string(h.Key)] = string(h.Value)
+	}
+	for key, value := range expected {
+		if headers[key] != value {
+			return fmt.Errorf("header %s is '%s', expected '%s'",
+				key, headers[key], value)
+		}
+	}
+	return nil
+}
+
+// TestPipelineDrain processes the messages still in the input channel
+// after the shutdown and commits their offsets before the handler
+// exits
+func TestPipelineDrain(t *testing.T) {
+	p := newPipeline(t, `drain`, func(producer *mocks.AsyncProducer) {
+		producer.ExpectInputWithMessageCheckerFunctionAndSucceed(derived)
+		producer.ExpectInputWithMessageCheckerFunctionAndSucceed(derived)
+	})
+
+	// fill the input channel before the handler runs
+	p.send(0, `/sys/cpu/ctx`, 0, 100000)
+	p.send(1, `/sys/cpu/ctx`, 1, 160000)
+	p.send(2, `/sys/cpu/ctx`, 2, 190000)
+	close(p.h.Shutdown)
+	close(p.h.Input)
+	p.start()
+	p.wait()
+
+	// all commits are sent before the handler exits
+	var offset int64 = -1
+	for len(p.commits) > 0 {
+		c := <-p.commits
+		if c.Offset < offset {
+			t.Errorf("commit of offset %d after offset %d",
+				c.Offset, offset)
+		}
+		offset = c.Offset
+	}
+	if offset != 2 {
+		t.Errorf("committed offset %d, expected 2", offset)
+	}
+}
+
+// TestPipelineProducerError reports a failed produce as fatal error
+// and does not commit the offsets of the derived metric
+func TestPipelineProducerError(t *testing.T) {
+	p := newPipeline(t, `error`, func(producer *mocks.AsyncProducer) {
+		producer.ExpectInputAndFail(sarama.ErrOutOfBrokers)
+	})
+	p.start()
+
+	p.send(0, `/sys/cpu/ctx`, 0, 100000)
+	p.send(1, `/sys/cpu/ctx`, 1, 160000)
+
+	select {
+	case err := <-p.h.Death:
+		perr, ok := err.(*sarama.ProducerError)
+		if !ok || perr.Err != sarama.ErrOutOfBrokers {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(timeout):
+		t.Fatal(`producer error was not reported`)
+	}
+
+	close(p.h.Shutdown)
+	p.wait()
+	p.uncommitted()
+}
+
+// TestPipelineBrokerError reports a failed broker discovery as fatal
+// error
+func TestPipelineBrokerError(t *testing.T) {
+	p := newPipeline(t, `brokers`, func(*mocks.AsyncProducer) {})
+	p.h.Brokers = func(*erebos.Config) ([]string, error) {
+		return nil, sarama.ErrOutOfBrokers
+	}
+	p.start()
+
+	select {
+	case err := <-p.h.Death:
+		if err != sarama.ErrOutOfBrokers {
+			t.Errorf("unexpected error: %v", err)
+		}
+	case <-time.After(timeout):
+		t.Fatal(`broker error was not reported`)
+	}
+
+	close(p.h.Shutdown)
+	p.wait()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,132 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package hurricane // import "github.com/solnx/hurricane/internal/hurricane"
+
+import (
+	"sync"
+
+	"github.com/mjolnir42/erebos"
+)
+
+// offsetTracker records the consumed offsets of all partitions and
+// which of them have been fully processed. Since messages from one
+// partition are spread across all handlers, a single offsetTracker is
+// shared by all of them.
+type offsetTracker struct {
+	sync.Mutex
+	partitions map[string]map[int32]*partitionTracker
+}
+
+// partitionTracker tracks the offsets of a single partition
+type partitionTracker struct {
+	// consumed offsets that have not been committed, in the order
+	// they were consumed
+	outstanding []int64
+	// set of the outstanding offsets
+	pending map[int64]struct{}
+	// offsets that have been processed, but can not be committed
+	// before all earlier offsets have been processed
+	done map[int64]struct{}
+	// last consumed offset
+	last int64
+}
+
+// newPartitionTracker returns a partitionTracker without offsets
+func newPartitionTracker() *partitionTracker {
+	return &partitionTracker{
+		outstanding: []int64{},
+		pending:     make(map[int64]struct{}),
+		done:        make(map[int64]struct{}),
+		last:        -1,
+	}
+}
+
+// newOffsetTracker returns a new offsetTracker
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{
+		partitions: make(map[string]map[int32]*partitionTracker),
+	}
+}
+
+// track registers msg as consumed, but not yet processed
+func (o *offsetTracker) track(msg *erebos.Transport) {
+	o.Lock()
+	defer o.Unlock()
+
+	if _, ok := o.partitions[msg.Topic]; !ok {
+		o.partitions[msg.Topic] = make(map[int32]*partitionTracker)
+	}
+	p, ok := o.partitions[msg.Topic][msg.Partition]
+	// offsets of a partition are consumed in ascending order, unless
+	// the partition was reassigned and Kafka redelivers from the
+	// committed offset. The offsets of the previous assignment are no
+	// longer tracked, their late completion is ignored.
+	if !ok || msg.Offset <= p.last {
+		p = newPartitionTracker()
+		o.partitions[msg.Topic][msg.Partition] = p
+	}
+	p.last = msg.Offset
+	p.outstanding = append(p.outstanding, msg.Offset)
+	p.pending[msg.Offset] = struct{}{}
+}
+
+// processed marks msg as fully processed. If this completes a
+// contiguous range of processed offsets, it returns the highest offset
+// of that range and true. The returned offset can be safely
+// committed. Messages of untracked partitions are returned as is,
+// offsets that are not outstanding are ignored.
+func (o *offsetTracker) processed(msg *erebos.Transport) (int64, bool) {
+	o.Lock()
+	defer o.Unlock()
+
+	if _, ok := o.partitions[msg.Topic]; !ok {
+		return msg.Offset, true
+	}
+	p, ok := o.partitions[msg.Topic][msg.Partition]
+	if !ok {
+		return msg.Offset, true
+	}
+
+	// committed twice or consumed before the partition was
+	// reassigned
+	if _, ok := p.pending[msg.Offset]; !ok {
+		return 0, false
+	}
+
+	p.done[msg.Offset] = struct{}{}
+	commit, advanced := int64(0), false
+	for len(p.outstanding) > 0 {
+		if _, ok := p.done[p.outstanding[0]]; !ok {
+			break
+		}
+		commit, advanced = p.outstanding[0], true
+		delete(p.done, p.outstanding[0])
+		delete(p.pending, p.outstanding[0])
+		p.outstanding = p.outstanding[1:]
+	}
+	return commit, advanced
+}
+
+// gap returns the number of processed offsets across all partitions
+// that can not be committed, because an earlier offset is still being
+// processed
+func (o *offsetTracker) gap() int64 {
+	o.Lock()
+	defer o.Unlock()
+
+	var gap int64
+	for topic := range o.partitions {
+		for partition := range o.partitions[topic] {
+			gap += int64(len(o.partitions[topic][partition].done))
+		}
+	}
+	return gap
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,74 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package hurricane // import "github.com/solnx/hurricane/internal/hurricane"
+
+import (
+	"testing"
+
+	"github.com/mjolnir42/erebos"
+)
+
+// transport returns the transport for offset of the tracker tests
+func transport(offset int64) *erebos.Transport {
+	return &erebos.Transport{Topic: `tracker`, Offset: offset}
+}
+
+// expectCommit checks the result of marking offset as processed
+func expectCommit(t *testing.T, o *offsetTracker, offset, commit int64, ok bool) {
+	c, advanced := o.processed(transport(offset))
+	if advanced != ok || (ok && c != commit) {
+		t.Errorf("processed %d: got %d, %t, expected %d, %t",
+			offset, c, advanced, commit, ok)
+	}
+}
+
+// TestTrackerProcessedTwice ignores offsets that are processed again
+// after they were committed
+func TestTrackerProcessedTwice(t *testing.T) {
+	o := newOffsetTracker()
+	for offset := int64(0); offset < 3; offset++ {
+		o.track(transport(offset))
+	}
+
+	expectCommit(t, o, 1, 0, false)
+	expectCommit(t, o, 1, 0, false)
+	expectCommit(t, o, 0, 1, true)
+	expectCommit(t, o, 0, 0, false)
+	expectCommit(t, o, 1, 0, false)
+	if gap := o.gap(); gap != 0 {
+		t.Errorf("gap is %d, expected 0", gap)
+	}
+	expectCommit(t, o, 2, 2, true)
+}
+
+// TestTrackerRedelivery tracks the offsets Kafka redelivers after a
+// rebalance once, and ignores the late completion of the offsets
+// consumed before
+func TestTrackerRedelivery(t *testing.T) {
+	o := newOffsetTracker()
+	for offset := int64(5); offset < 8; offset++ {
+		o.track(transport(offset))
+	}
+	expectCommit(t, o, 5, 5, true)
+	expectCommit(t, o, 7, 0, false)
+
+	// the commit of offset 5 did not reach Kafka before the rebalance
+	for offset := int64(5); offset < 8; offset++ {
+		o.track(transport(offset))
+	}
+	expectCommit(t, o, 5, 5, true)
+	expectCommit(t, o, 6, 6, true)
+	expectCommit(t, o, 7, 7, true)
+	expectCommit(t, o, 7, 0, false)
+	if gap := o.gap(); gap != 0 {
+		t.Errorf("gap is %d, expected 0", gap)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -11,13 +11,17 @@
 package intf // import "github.com/solnx/hurricane/internal/intf"
 
 import (
+	"time"
+
 	"github.com/mjolnir42/erebos"
 	"github.com/solnx/legacy"
 )
 
 // Deriver is the interface for packages that calculate derived metrics
 type Deriver interface {
-	// Using Register the deriver sets itself as handler for its metrics
+	// Using Register the deriver sets itself as handler for its metrics.
+	// Multiple derivers can register for the same metric, each of them
+	// receives every update.
 	Register(m map[string]Deriver)
 	// Update provides the Deriver with a new input metric. If there are
 	// derived metrics or message offsets to handle it will also return
@@ -29,4 +33,43 @@ type Deriver interface {
 	Close()
 }
 
+// Evictor is the interface for Derivers that can remove the state of
+// assets that stopped sending metrics
+type Evictor interface {
+	// Evict removes all state that has not been updated since
+	// deadline. It returns the outstanding acknowledgements of the
+	// removed state and the number of evicted entries.
+	Evict(deadline time.Time) ([]*erebos.Transport, int)
+}
+
+// Dropper is the interface for Derivers that can remove the state of
+// a single asset
+type Dropper interface {
+	// Drop removes all state of assetID, for example after a panic
+	// left it inconsistent. It returns the outstanding
+	// acknowledgements of the removed state.
+	Drop(assetID int64) []*erebos.Transport
+}
+
+// Expirer is the interface for Derivers that can give up on
+// distributions that are never completed
+type Expirer interface {
+	// Expire ends all distributions that were started before deadline
+	// and are still incomplete. If partial is set, the Deriver tries
+	// to evaluate them with the values received so far, otherwise
+	// they are dropped. It returns the derived metrics, the released
+	// acknowledgements and the number of dropped and evaluated
+	// distributions.
+	Expire(deadline time.Time, partial bool) ([]*legacy.MetricSplit, []*erebos.Transport, int, int, error)
+}
+
+// Ticker is the interface for Derivers that calculate derived metrics
+// based on time instead of input metrics
+type Ticker interface {
+	// Tick is called periodically with the current time. Like
+	// Update, it returns derived metrics and releasable
+	// acknowledgements and reports true if there are any.
+	Tick(now time.Time) ([]*legacy.MetricSplit, []*erebos.Transport, bool, error)
+}
+
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,85 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package intf // import "github.com/solnx/hurricane/internal/intf"
+
+import (
+	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/legacy"
+)
+
+// TagLookup is the interface for the lookup of the tags of derived
+// metrics. It is implemented by wall.Lookup.
+type TagLookup interface {
+	// Start connects the lookup to its backends
+	Start() error
+	// Close disconnects the lookup from its backends
+	Close()
+	// GetConfigurationID returns the tags configured for the metric
+	// identified by lookID. It returns wall.ErrUnconfigured if there
+	// is no configuration for the metric.
+	GetConfigurationID(lookID string) ([]string, error)
+	// Heartbeat records that handler num of application app is alive
+	Heartbeat(app string, num int, data []byte)
+}
+
+// MultiLookup is the interface for TagLookups that resolve the tags
+// of multiple metrics in one call
+type MultiLookup interface {
+	// LookupAll returns the tags of all configured metrics in
+	// lookIDs, indexed by lookID. Metrics without configuration are
+	// not part of the result.
+	LookupAll(lookIDs []string) (map[string][]string, error)
+}
+
+// Degrader is the interface for TagLookups that continue without tags
+// while their backend is unavailable
+type Degrader interface {
+	// Degraded reports whether the backend is unavailable
+	Degraded() bool
+}
+
+// verify that wall.Lookup implements TagLookup
+var _ TagLookup = &wall.Lookup{}
+
+// LookupTags sets the tags of all derived metrics using lookup. The
+// metrics are resolved in one call if lookup implements MultiLookup.
+// Metrics without configuration are left untagged.
+func LookupTags(lookup TagLookup, derived []*legacy.MetricSplit) error {
+	if multi, ok := lookup.(MultiLookup); ok {
+		lookIDs := make([]string, len(derived))
+		for i := range derived {
+			lookIDs[i] = derived[i].LookupID()
+		}
+		tags, err := multi.LookupAll(lookIDs)
+		if err != nil {
+			return err
+		}
+		for i := range derived {
+			if t, ok := tags[lookIDs[i]]; ok {
+				derived[i].Tags = t
+			}
+		}
+		return nil
+	}
+
+	for i := range derived {
+		tags, err := lookup.GetConfigurationID(derived[i].LookupID())
+		switch err {
+		case nil:
+			// there are checks for this metric
+			derived[i].Tags = tags
+		case wall.ErrUnconfigured:
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
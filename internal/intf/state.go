@@ -0,0 +1,79 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package intf // import "github.com/solnx/hurricane/internal/intf"
+
+import (
+	"github.com/mjolnir42/erebos"
+)
+
+// Stateful is the interface for Derivers that can persist their
+// accumulated state across restarts
+type Stateful interface {
+	// Snapshot returns the serialized state of the Deriver
+	Snapshot() ([]byte, error)
+	// Restore loads a state previously returned by Snapshot
+	Restore(state []byte) error
+}
+
+// Offset is the position of a consumed message within Kafka. It is
+// used to persist outstanding acknowledgements, since a Transport
+// can not be serialized.
+type Offset struct {
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// NewOffset returns the Offset of t
+func NewOffset(t *erebos.Transport) Offset {
+	return Offset{
+		Topic:     t.Topic,
+		Partition: t.Partition,
+		Offset:    t.Offset,
+	}
+}
+
+// Offsets returns the Offsets of all transports in acks
+func Offsets(acks []*erebos.Transport) []Offset {
+	o := make([]Offset, 0, len(acks))
+	for i := range acks {
+		o = append(o, NewOffset(acks[i]))
+	}
+	return o
+}
+
+// Matches checks if t is the message identified by o
+func (o Offset) Matches(t *erebos.Transport) bool {
+	return o.Topic == t.Topic && o.Partition == t.Partition &&
+		o.Offset == t.Offset
+}
+
+// Claim removes the Offset matching t from pending. Since the
+// messages of a partition are redelivered in order, the Offsets of
+// t's partition that precede t are removed as well: they were
+// committed before the restart and are never redelivered. It returns
+// the remaining pending Offsets and whether a match was found.
+func Claim(pending []Offset, t *erebos.Transport) ([]Offset, bool) {
+	remaining := pending[:0]
+	found := false
+	for i := range pending {
+		switch {
+		case pending[i].Matches(t):
+			found = true
+		case pending[i].Topic == t.Topic &&
+			pending[i].Partition == t.Partition &&
+			pending[i].Offset < t.Offset:
+		default:
+			remaining = append(remaining, pending[i])
+		}
+	}
+	return remaining, found
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
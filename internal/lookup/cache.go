@@ -0,0 +1,351 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package lookup // import "github.com/solnx/hurricane/internal/lookup"
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	metrics "github.com/rcrowley/go-metrics"
+	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/hurricane/internal/intf"
+)
+
+const (
+	// DefaultCacheSize is the number of cached lookups if no size
+	// is configured
+	DefaultCacheSize = 16384
+	// DefaultCacheTTL is the time a lookup is cached if no TTL is
+	// configured
+	DefaultCacheTTL = 5 * time.Minute
+	// backoff is the time the backend is not queried after it
+	// failed while the Cache is degraded
+	backoff = 10 * time.Second
+)
+
+// Policy defines how a Cache handles lookup failures of its backend
+type Policy string
+
+// Supported failure policies
+const (
+	// PolicyFail returns the error of the backend
+	PolicyFail Policy = `fail`
+	// PolicyUntagged leaves the metrics untagged
+	PolicyUntagged Policy = `untagged`
+	// PolicyLastKnown uses the last known tags, even if they are
+	// expired. Metrics without known tags are left untagged.
+	PolicyLastKnown Policy = `last-known`
+	// PolicyRetry leaves the metrics untagged and reports the Cache
+	// as degraded, so the caller can hold the metrics and tag them
+	// again once the backend is available
+	PolicyRetry Policy = `retry`
+)
+
+// ParsePolicy returns the Policy for s. The empty string selects
+// PolicyFail.
+func ParsePolicy(s string) (Policy, error) {
+	switch Policy(s) {
+	case ``:
+		return PolicyFail, nil
+	case PolicyFail, PolicyUntagged, PolicyLastKnown, PolicyRetry:
+		return Policy(s), nil
+	}
+	return ``, fmt.Errorf("lookup: unknown failure policy '%s'", s)
+}
+
+// Cache is an intf.TagLookup that caches the results of a backend
+// lookup in a bounded LRU. It is safe for concurrent use and intended
+// to be shared by all handlers and derivers of a process. The backend
+// is started by the first call to Start and closed by the matching
+// last call to Close. Unless the policy is PolicyFail, backend
+// errors do not fail a lookup but put the Cache into degraded state
+// until the backend answers again.
+type Cache struct {
+	backend  intf.TagLookup
+	size     int
+	ttl      time.Duration
+	policy   Policy
+	mutex    sync.Mutex
+	users    int
+	entries  map[string]*list.Element
+	order    *list.List
+	degraded bool
+	retryAt  time.Time
+	hits     metrics.Counter
+	misses   metrics.Counter
+	errors   metrics.Counter
+	fallback metrics.Counter
+	state    metrics.Gauge
+}
+
+// cacheEntry is the cached lookup result for one lookID. Metrics
+// without configuration are cached as unconfigured.
+type cacheEntry struct {
+	lookID       string
+	tags         []string
+	unconfigured bool
+	expires      time.Time
+}
+
+// NewCache returns a Cache for backend holding up to size entries
+// for ttl, handling backend errors according to policy. Its metrics
+// are registered with registry.
+func NewCache(backend intf.TagLookup, size int, ttl time.Duration, policy Policy, registry metrics.Registry) *Cache {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	return &Cache{
+		backend: backend,
+		size:    size,
+		ttl:     ttl,
+		policy:  policy,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		hits: metrics.GetOrRegisterCounter(
+			`/lookup/cache.hits`, registry),
+		misses: metrics.GetOrRegisterCounter(
+			`/lookup/cache.misses`, registry),
+		errors: metrics.GetOrRegisterCounter(
+			`/lookup/errors`, registry),
+		fallback: metrics.GetOrRegisterCounter(
+			`/lookup/fallback`, registry),
+		state: metrics.GetOrRegisterGauge(
+			`/lookup/degraded`, registry),
+	}
+}
+
+// Start starts the backend on first use
+func (c *Cache) Start() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.users == 0 {
+		if err := c.backend.Start(); err != nil {
+			return err
+		}
+	}
+	c.users++
+	return nil
+}
+
+// Close closes the backend once the last user is done
+func (c *Cache) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.users == 0 {
+		return
+	}
+	c.users--
+	if c.users == 0 {
+		c.backend.Close()
+	}
+}
+
+// Heartbeat is passed through to the backend
+func (c *Cache) Heartbeat(app string, num int, data []byte) {
+	c.backend.Heartbeat(app, num, data)
+}
+
+// GetConfigurationID returns the tags configured for lookID
+func (c *Cache) GetConfigurationID(lookID string) ([]string, error) {
+	tags, err := c.LookupAll([]string{lookID})
+	if err != nil {
+		return nil, err
+	}
+	if t, ok := tags[lookID]; ok {
+		return t, nil
+	}
+	return nil, wall.ErrUnconfigured
+}
+
+// LookupAll returns the tags of all configured metrics in lookIDs.
+// The cache is checked for all lookIDs at once, the misses are looked
+// up in the backend in a single request if it implements
+// intf.MultiLookup.
+func (c *Cache) LookupAll(lookIDs []string) (map[string][]string, error) {
+	result := make(map[string][]string, len(lookIDs))
+	missing := []string{}
+	stale := make(map[string][]string)
+	seen := make(map[string]struct{}, len(lookIDs))
+	now := time.Now()
+
+	c.mutex.Lock()
+	for _, lookID := range lookIDs {
+		if _, ok := seen[lookID]; ok {
+			continue
+		}
+		seen[lookID] = struct{}{}
+
+		e, fresh := c.get(lookID, now)
+		if !fresh {
+			c.misses.Inc(1)
+			missing = append(missing, lookID)
+			if e != nil && !e.unconfigured {
+				stale[lookID] = e.tags
+			}
+			continue
+		}
+		c.hits.Inc(1)
+		if !e.unconfigured {
+			result[lookID] = append([]string{}, e.tags...)
+		}
+	}
+	// do not query a failed backend again before the backoff
+	skip := c.degraded && now.Before(c.retryAt)
+	c.mutex.Unlock()
+
+	// the backend is queried without holding the lock
+	var tags map[string][]string
+	var resolved []string
+	var err error
+	if !skip && len(missing) > 0 {
+		tags, resolved, err = c.fetch(missing)
+	}
+	for _, lookID := range resolved {
+		if t, ok := tags[lookID]; ok {
+			result[lookID] = t
+			c.add(lookID, t, false, now)
+			continue
+		}
+		c.add(lookID, nil, true, now)
+	}
+	if len(resolved) > 0 {
+		c.recovered()
+	}
+	if len(resolved) == len(missing) {
+		return result, nil
+	}
+	if err != nil {
+		if c.policy == PolicyFail {
+			return nil, err
+		}
+		c.fail(err, now)
+	}
+
+	// the backend is unavailable, fall back for all remaining metrics
+	for _, id := range missing[len(resolved):] {
+		c.fallback.Inc(1)
+		if t, ok := stale[id]; ok && c.policy == PolicyLastKnown {
+			result[id] = append([]string{}, t...)
+		}
+	}
+	return result, nil
+}
+
+// fetch looks up lookIDs in the backend. Backends that implement
+// intf.MultiLookup are queried once for all lookIDs, other backends
+// once per lookID. It returns the tags of the configured metrics and
+// the lookIDs that were resolved before the backend failed.
+func (c *Cache) fetch(lookIDs []string) (map[string][]string, []string, error) {
+	if multi, ok := c.backend.(intf.MultiLookup); ok {
+		tags, err := multi.LookupAll(lookIDs)
+		if err != nil {
+			return nil, nil, err
+		}
+		return tags, lookIDs, nil
+	}
+
+	tags := make(map[string][]string, len(lookIDs))
+	for i, lookID := range lookIDs {
+		t, err := c.backend.GetConfigurationID(lookID)
+		switch err {
+		case nil:
+			tags[lookID] = t
+		case wall.ErrUnconfigured:
+		default:
+			return tags, lookIDs[:i], err
+		}
+	}
+	return tags, lookIDs, nil
+}
+
+// Degraded reports whether the backend of c is currently unavailable
+func (c *Cache) Degraded() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.degraded
+}
+
+// fail puts c into degraded state after the backend returned err
+func (c *Cache) fail(err error, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.errors.Inc(1)
+	c.retryAt = now.Add(backoff)
+	if !c.degraded {
+		logrus.Errorf("Tag lookup degraded, continuing with policy %s: %s",
+			c.policy, err.Error())
+		c.degraded = true
+		c.state.Update(1)
+	}
+}
+
+// recovered ends the degraded state of c after the backend answered
+func (c *Cache) recovered() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.degraded {
+		logrus.Warnln(`Tag lookup recovered`)
+		c.degraded = false
+		c.state.Update(0)
+	}
+}
+
+// get returns the cache entry for lookID or nil, and whether the
+// entry is unexpired. Expired entries are kept as last known tags
+// until they are replaced or evicted. The caller must hold c.mutex.
+func (c *Cache) get(lookID string, now time.Time) (*cacheEntry, bool) {
+	elem, ok := c.entries[lookID]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*cacheEntry)
+	if now.After(e.expires) {
+		return e, false
+	}
+	c.order.MoveToFront(elem)
+	return e, true
+}
+
+// add caches the lookup result for lookID and removes the least
+// recently used entries beyond the size of c
+func (c *Cache) add(lookID string, tags []string, unconfigured bool, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	e := &cacheEntry{
+		lookID:       lookID,
+		tags:         append([]string{}, tags...),
+		unconfigured: unconfigured,
+		expires:      now.Add(c.ttl),
+	}
+	if elem, ok := c.entries[lookID]; ok {
+		elem.Value = e
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[lookID] = c.order.PushFront(e)
+
+	for c.order.Len() > c.size {
+		elem := c.order.Back()
+		c.order.Remove(elem)
+		delete(c.entries, elem.Value.(*cacheEntry).lookID)
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
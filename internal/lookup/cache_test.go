@@ -0,0 +1,61 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package lookup // import "github.com/solnx/hurricane/internal/lookup"
+
+import (
+	"fmt"
+	"testing"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// TestCacheLookupAll looks up the misses of a cold cache in a single
+// backend request and serves the following lookups from the cache
+func TestCacheLookupAll(t *testing.T) {
+	backend := NewMemory()
+	lookIDs := []string{}
+	for i := 0; i < 11; i++ {
+		lookIDs = append(lookIDs, fmt.Sprintf("metric%d", i))
+	}
+	backend.Set(lookIDs[0], []string{`check`})
+	c := NewCache(backend, 0, 0, PolicyFail, metrics.NewRegistry())
+
+	for round := 0; round < 2; round++ {
+		tags, err := c.LookupAll(lookIDs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tags) != 1 || len(tags[lookIDs[0]]) != 1 {
+			t.Errorf("round %d: unexpected tags %v", round, tags)
+		}
+	}
+	if n := backend.Lookups(); n != 1 {
+		t.Errorf("%d backend lookups, expected 1", n)
+	}
+}
+
+// TestCacheLookupAllDegraded leaves the metrics untagged if the
+// backend request fails
+func TestCacheLookupAllDegraded(t *testing.T) {
+	backend := NewMemory()
+	backend.Set(`metric0`, []string{`check`})
+	backend.Fail(`metric1`, fmt.Errorf("redis unavailable"))
+	c := NewCache(backend, 0, 0, PolicyUntagged, metrics.NewRegistry())
+
+	tags, err := c.LookupAll([]string{`metric0`, `metric1`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 0 || !c.Degraded() {
+		t.Errorf("got tags %v, degraded %t, expected untagged and degraded",
+			tags, c.Degraded())
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,122 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+// Package lookup provides implementations of intf.TagLookup
+package lookup // import "github.com/solnx/hurricane/internal/lookup"
+
+import (
+	"sync"
+
+	wall "github.com/solnx/eye/lib/eye.wall"
+)
+
+// Memory is an in-memory implementation of intf.TagLookup that does
+// not require Redis or eyewall. It is intended for tests.
+type Memory struct {
+	mutex      sync.RWMutex
+	tags       map[string][]string
+	errors     map[string]error
+	lookups    int
+	heartbeats int
+}
+
+// NewMemory returns a Memory lookup without any configured tags
+func NewMemory() *Memory {
+	return &Memory{
+		tags:   make(map[string][]string),
+		errors: make(map[string]error),
+	}
+}
+
+// Set configures tags for the metric identified by lookID
+func (l *Memory) Set(lookID string, tags []string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.tags[lookID] = tags
+}
+
+// Fail makes lookups of the metric identified by lookID return err.
+// A nil err removes the failure.
+func (l *Memory) Fail(lookID string, err error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if err == nil {
+		delete(l.errors, lookID)
+		return
+	}
+	l.errors[lookID] = err
+}
+
+// Start ...
+func (l *Memory) Start() error {
+	return nil
+}
+
+// Close ...
+func (l *Memory) Close() {
+}
+
+// GetConfigurationID returns the tags set for lookID. It returns
+// wall.ErrUnconfigured if no tags are set.
+func (l *Memory) GetConfigurationID(lookID string) ([]string, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lookups++
+
+	if err, ok := l.errors[lookID]; ok {
+		return nil, err
+	}
+	tags, ok := l.tags[lookID]
+	if !ok {
+		return nil, wall.ErrUnconfigured
+	}
+	return append([]string{}, tags...), nil
+}
+
+// LookupAll returns the tags set for all lookIDs in a single lookup.
+// It fails if the lookup of one of them is set to fail.
+func (l *Memory) LookupAll(lookIDs []string) (map[string][]string, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lookups++
+
+	result := make(map[string][]string, len(lookIDs))
+	for _, lookID := range lookIDs {
+		if err, ok := l.errors[lookID]; ok {
+			return nil, err
+		}
+		if tags, ok := l.tags[lookID]; ok {
+			result[lookID] = append([]string{}, tags...)
+		}
+	}
+	return result, nil
+}
+
+// Heartbeat counts the received heartbeats
+func (l *Memory) Heartbeat(app string, num int, data []byte) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.heartbeats++
+}
+
+// Lookups returns the number of calls to GetConfigurationID and
+// LookupAll
+func (l *Memory) Lookups() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.lookups
+}
+
+// Heartbeats returns the number of calls to Heartbeat
+func (l *Memory) Heartbeats() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.heartbeats
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
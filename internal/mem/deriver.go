@@ -9,26 +9,41 @@
 package mem // import "github.com/solnx/hurricane/internal/mem"
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/mjolnir42/erebos"
-	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/hurricane/internal/config"
 	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/registry"
+	"github.com/solnx/hurricane/internal/reorder"
 	"github.com/solnx/legacy"
 )
 
 // Implementation of the intf.Deriver interface
 
+func init() {
+	registry.Register(`mem`, func(conf *erebos.Config, settings *config.Config, lookup intf.TagLookup) (intf.Deriver, error) {
+		return NewDeriver(lookup, settings.Deriver(`mem`)), nil
+	})
+}
+
 // NewDeriver ...
-func NewDeriver(conf *erebos.Config) *Deriver {
+func NewDeriver(lookup intf.TagLookup, settings config.Deriver) *Deriver {
 	d := &Deriver{}
 	d.Data = make(map[int64]*Mem)
-	d.lookup = wall.NewLookup(conf, `hurricane`)
+	d.lookup = lookup
+	d.window = time.Duration(settings.ReorderWindow) * time.Second
+	d.cycles = settings.ReorderCycles
 	return d
 }
 
 // Deriver ...
 type Deriver struct {
 	Data   map[int64]*Mem
-	lookup *wall.Lookup
+	lookup intf.TagLookup
+	window time.Duration
+	cycles int
 }
 
 // Start ...
@@ -45,6 +60,7 @@ func (d *Deriver) Close() {
 func (d *Deriver) Register(m map[string]intf.Deriver) {
 	for _, s := range []string{
 		`/sys/memory/active`,
+		`/sys/memory/available`,
 		`/sys/memory/buffers`,
 		`/sys/memory/cached`,
 		`/sys/memory/free`,
@@ -62,10 +78,78 @@ func (d *Deriver) Update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.
 	if _, ok := d.Data[m.AssetID]; !ok {
 		d.Data[m.AssetID] = &Mem{
 			lookup: d.lookup,
+			buffer: reorder.New(d.window, d.cycles),
 		}
 	}
 
 	return d.Data[m.AssetID].update(m, t)
 }
 
+// Snapshot ...
+func (d *Deriver) Snapshot() ([]byte, error) {
+	s := make(map[int64]state, len(d.Data))
+	for assetID := range d.Data {
+		s[assetID] = d.Data[assetID].export()
+	}
+	return json.Marshal(s)
+}
+
+// Restore ...
+func (d *Deriver) Restore(b []byte) error {
+	s := make(map[int64]state)
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	for assetID := range s {
+		d.Data[assetID] = &Mem{
+			lookup: d.lookup,
+			buffer: reorder.New(d.window, d.cycles),
+		}
+		d.Data[assetID].load(s[assetID])
+	}
+	return nil
+}
+
+// Evict ...
+func (d *Deriver) Evict(deadline time.Time) ([]*erebos.Transport, int) {
+	acks := []*erebos.Transport{}
+	var evicted int
+	for assetID := range d.Data {
+		if d.Data[assetID].lastSeen.Before(deadline) {
+			acks = append(acks, d.Data[assetID].outstanding()...)
+			delete(d.Data, assetID)
+			evicted++
+		}
+	}
+	return acks, evicted
+}
+
+// Drop ...
+func (d *Deriver) Drop(assetID int64) []*erebos.Transport {
+	acks := []*erebos.Transport{}
+	if _, ok := d.Data[assetID]; ok {
+		acks = append(acks, d.Data[assetID].outstanding()...)
+		delete(d.Data, assetID)
+	}
+	return acks
+}
+
+// Expire ...
+func (d *Deriver) Expire(deadline time.Time, partial bool) ([]*legacy.MetricSplit, []*erebos.Transport, int, int, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var dropped, evaluated int
+	for assetID := range d.Data {
+		m, a, drp, evl, err := d.Data[assetID].expire(deadline, partial)
+		if err != nil {
+			return nil, nil, 0, 0, err
+		}
+		derived = append(derived, m...)
+		acks = append(acks, a...)
+		dropped += drp
+		evaluated += evl
+	}
+	return derived, acks, dropped, evaluated, nil
+}
+
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
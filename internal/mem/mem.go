@@ -8,6 +8,17 @@
 
 // Package mem provides the following derived metrics:
 //	- memory.usage.percent
+//	- memory.available.percent
+//	- memory.cached.bytes
+//	- memory.active.percent
+//	- swap.usage.percent
+//
+// memory.usage.percent counts everything but free memory as used.
+// memory.available.percent is taken from /sys/memory/available if the
+// host reports it, otherwise free, buffers and cached memory count as
+// available. Once available memory has been seen for a host, it is
+// required for its distributions to be complete. swap.usage.percent is
+// not derived for hosts without swap space.
 package mem // import "github.com/solnx/hurricane/internal/mem"
 
 import (
@@ -17,25 +28,34 @@ import (
 	"time"
 
 	"github.com/mjolnir42/erebos"
-	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/numeric"
+	"github.com/solnx/hurricane/internal/reorder"
 	"github.com/solnx/legacy"
 )
 
 // Mem implements the metric evaluation and accounting for monitoring
 // of memory metrics
 type Mem struct {
-	assetID  int64
-	curr     distribution
-	next     distribution
-	currTime time.Time
-	nextTime time.Time
-	usage    float64
-	lookup   *wall.Lookup
-	ack      []*erebos.Transport
+	assetID          int64
+	curr             distribution
+	next             distribution
+	currTime         time.Time
+	nextTime         time.Time
+	usage            float64
+	reportsAvailable bool
+	lookup           intf.TagLookup
+	ack              []*erebos.Transport
+	pending          []intf.Offset
+	lastSeen         time.Time
+	buffer           *reorder.Buffer
 }
 
 // Update adds mtr to the next distribution tracked by Mem
 func (m *Mem) update(mtr *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	// track activity for the eviction of idle state
+	m.lastSeen = time.Now()
+
 	// set assetID on first use
 	if m.assetID == 0 {
 		m.assetID = mtr.AssetID
@@ -47,55 +67,102 @@ func (m *Mem) update(mtr *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.Me
 		return []*legacy.MetricSplit{}, []*erebos.Transport{t}, true, nil
 	}
 
-processing:
-	// first metric for this distribution
-	if m.nextTime.IsZero() {
-		m.nextTime = mtr.TS
+	// redelivery of a message that is part of the restored state
+	pending, claimed := intf.Claim(m.pending, t)
+	m.pending = pending
+	if claimed {
+		m.ack = append(m.ack, t)
+		return nil, nil, false, nil
 	}
 
-	// out of order metric for old timestamp
-	if m.nextTime.After(mtr.TS) {
+	value, err := numeric.Int64(mtr)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	// available memory is required once a valid value has been seen
+	if mtr.Path == `/sys/memory/available` {
+		m.reportsAvailable = true
+	}
+
+	// metric for a measurement cycle that was already evaluated
+	if !m.currTime.IsZero() && !mtr.TS.After(m.currTime) {
 		return []*legacy.MetricSplit{}, []*erebos.Transport{t}, true, nil
 	}
 
-	// abandon current next and start new one
-	if m.nextTime.Before(mtr.TS) {
-		m.nextTime = time.Time{}
-		m.next = distribution{}
-		goto processing
-	}
-
-	if m.nextTime.Equal(mtr.TS) {
-		switch mtr.Path {
-		case `/sys/memory/active`:
-			m.next.active = mtr.Value().(int64)
-			m.next.setActive = true
-		case `/sys/memory/buffers`:
-			m.next.buffers = mtr.Value().(int64)
-			m.next.setBuffers = true
-		case `/sys/memory/cached`:
-			m.next.cached = mtr.Value().(int64)
-			m.next.setCached = true
-		case `/sys/memory/free`:
-			m.next.free = mtr.Value().(int64)
-			m.next.setFree = true
-		case `/sys/memory/inactive`:
-			m.next.inactive = mtr.Value().(int64)
-			m.next.setInactive = true
-		case `/sys/memory/swapfree`:
-			m.next.swapFree = mtr.Value().(int64)
-			m.next.setSwapFree = true
-		case `/sys/memory/swaptotal`:
-			m.next.swapTotal = mtr.Value().(int64)
-			m.next.setSwapTotal = true
-		case `/sys/memory/total`:
-			m.next.total = mtr.Value().(int64)
-			m.next.setTotal = true
-		}
+	e := m.buffer.Get(mtr.TS, func() interface{} {
+		return &distribution{}
+	})
+	next := e.Value.(*distribution)
+	switch mtr.Path {
+	case `/sys/memory/active`:
+		next.active = value
+		next.setActive = true
+	case `/sys/memory/available`:
+		next.available = value
+		next.setAvailable = true
+	case `/sys/memory/buffers`:
+		next.buffers = value
+		next.setBuffers = true
+	case `/sys/memory/cached`:
+		next.cached = value
+		next.setCached = true
+	case `/sys/memory/free`:
+		next.free = value
+		next.setFree = true
+	case `/sys/memory/inactive`:
+		next.inactive = value
+		next.setInactive = true
+	case `/sys/memory/swapfree`:
+		next.swapFree = value
+		next.setSwapFree = true
+	case `/sys/memory/swaptotal`:
+		next.swapTotal = value
+		next.setSwapTotal = true
+	case `/sys/memory/total`:
+		next.total = value
+		next.setTotal = true
 	}
+	e.Acks = append(e.Acks, t)
 
-	m.ack = append(m.ack, t)
-	return m.calculate()
+	// distributions that fell out of the reorder window are abandoned
+	abandoned := m.buffer.Trim()
+
+	derived, acks, ok, err := m.evaluate()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if len(abandoned) > 0 {
+		return derived, append(acks, abandoned...), true, nil
+	}
+	return derived, acks, ok, nil
+}
+
+// evaluate calculates the derived metrics for all complete
+// distributions at the start of the reorder buffer in timestamp order.
+// Evaluation stops at the first incomplete distribution.
+func (m *Mem) evaluate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var ok bool
+
+	for e := m.buffer.Oldest(); e != nil && e.Value.(*distribution).valid(m.reportsAvailable); e = m.buffer.Oldest() {
+		m.buffer.Pop()
+		m.next = *e.Value.(*distribution)
+		m.nextTime = e.TS
+		m.ack = append(m.ack, e.Acks...)
+
+		res, a, done, err := m.calculate()
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if done {
+			derived = append(derived, res...)
+			acks = append(acks, a...)
+			ok = true
+		}
+	}
+	return derived, acks, ok, nil
 }
 
 // Calculate checks if the next distribution has been fully assembled
@@ -104,7 +171,7 @@ processing:
 // complete, it returns nil.
 func (m *Mem) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
 
-	if m.nextTime.IsZero() || !m.next.valid() {
+	if m.nextTime.IsZero() || !m.next.valid(m.reportsAvailable) {
 		return nil, nil, false, nil
 	}
 
@@ -129,6 +196,61 @@ func (m *Mem) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, err
 	return derived, acks, true, nil
 }
 
+// expire gives up on all distributions in the reorder buffer that were
+// started before deadline and are still incomplete. If partial is set,
+// missing values are carried over from the current distribution and
+// the result is evaluated. Otherwise, or if the result can still not
+// be evaluated, the distribution is dropped and its acknowledgements
+// are released. Complete distributions that were waiting for the
+// expired ones are evaluated afterwards. It returns the number of
+// dropped and partially evaluated distributions.
+func (m *Mem) expire(deadline time.Time, partial bool) ([]*legacy.MetricSplit, []*erebos.Transport, int, int, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var dropped, evaluated int
+
+	for e := m.buffer.Oldest(); e != nil && e.Start.Before(deadline); e = m.buffer.Oldest() {
+		m.buffer.Pop()
+		next := e.Value.(*distribution)
+		if !next.valid(m.reportsAvailable) && partial && !m.currTime.IsZero() {
+			next.fill(&m.curr)
+			if next.valid(m.reportsAvailable) {
+				evaluated++
+			}
+		}
+		if !next.valid(m.reportsAvailable) {
+			acks = append(acks, e.Acks...)
+			dropped++
+			continue
+		}
+
+		m.next = *next
+		m.nextTime = e.TS
+		m.ack = append(m.ack, e.Acks...)
+		res, a, ok, err := m.calculate()
+		if err != nil {
+			return nil, nil, 0, 0, err
+		}
+		if ok {
+			derived = append(derived, res...)
+			acks = append(acks, a...)
+		}
+	}
+
+	res, a, _, err := m.evaluate()
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	derived = append(derived, res...)
+	acks = append(acks, a...)
+	return derived, acks, dropped, evaluated, nil
+}
+
+// outstanding returns all acknowledgements held by m
+func (m *Mem) outstanding() []*erebos.Transport {
+	return append(m.buffer.Acks(), m.ack...)
+}
+
 // nextToCurrent advances the distributions within Mem by one step
 func (m *Mem) nextToCurrent() {
 	m.currTime = m.nextTime
@@ -138,8 +260,7 @@ func (m *Mem) nextToCurrent() {
 	m.next = distribution{}
 }
 
-// emitMetric returns a legacy.MetricSplit for metric path
-// memory.usage.percent with the m.Usage as value
+// emitMetric returns the derived metrics for the current distribution
 func (m *Mem) emitMetric() ([]*legacy.MetricSplit, error) {
 	mup := &legacy.MetricSplit{
 		AssetID: m.assetID,
@@ -151,20 +272,68 @@ func (m *Mem) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: m.usage,
 		},
 	}
-	if tags, err := m.lookup.GetConfigurationID(
-		mup.LookupID(),
-	); err == nil {
-		mup.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		return []*legacy.MetricSplit{}, err
+
+	// the memory counters are reported in kB
+	mcb := &legacy.MetricSplit{
+		AssetID: m.assetID,
+		Path:    `memory.cached.bytes`,
+		TS:      m.currTime,
+		Type:    `integer`,
+		Unit:    `B`,
+		Val: legacy.MetricValue{
+			IntVal: m.curr.cached * 1024,
+		},
 	}
 
-	return []*legacy.MetricSplit{mup}, nil
+	result := []*legacy.MetricSplit{mup, mcb}
+	if m.curr.total > 0 {
+		mavp := &legacy.MetricSplit{
+			AssetID: m.assetID,
+			Path:    `memory.available.percent`,
+			TS:      m.currTime,
+			Type:    `real`,
+			Unit:    `%`,
+			Val: legacy.MetricValue{
+				FlpVal: percent(m.curr.availableBytes(), m.curr.total),
+			},
+		}
+		macp := &legacy.MetricSplit{
+			AssetID: m.assetID,
+			Path:    `memory.active.percent`,
+			TS:      m.currTime,
+			Type:    `real`,
+			Unit:    `%`,
+			Val: legacy.MetricValue{
+				FlpVal: percent(m.curr.active, m.curr.total),
+			},
+		}
+		result = append(result, mavp, macp)
+	}
+	if m.curr.swapTotal > 0 {
+		result = append(result, &legacy.MetricSplit{
+			AssetID: m.assetID,
+			Path:    `swap.usage.percent`,
+			TS:      m.currTime,
+			Type:    `real`,
+			Unit:    `%`,
+			Val: legacy.MetricValue{
+				FlpVal: percent(m.curr.swapTotal-m.curr.swapFree,
+					m.curr.swapTotal),
+			},
+		})
+	}
+
+	if err := intf.LookupTags(m.lookup, result); err != nil {
+		// do not emit potentially incorrect metrics
+		return []*legacy.MetricSplit{}, err
+	}
+	return result, nil
 }
 
 // distribution is used to track multiple memory metrics from the same
 // measurement cycle
 type distribution struct {
+	setAvailable bool
 	setTotal     bool
 	setActive    bool
 	setBuffers   bool
@@ -173,6 +342,7 @@ type distribution struct {
 	setInactive  bool
 	setSwapFree  bool
 	setSwapTotal bool
+	available    int64
 	total        int64
 	active       int64
 	buffers      int64
@@ -183,10 +353,64 @@ type distribution struct {
 	swapTotal    int64
 }
 
-// valid checks if a distribution has been fully populated
-func (m *distribution) valid() bool {
+// valid checks if a distribution has been fully populated, including
+// the available memory if the host reports it
+func (m *distribution) valid(available bool) bool {
 	return m.setTotal && m.setActive && m.setBuffers && m.setCached &&
-		m.setFree && m.setInactive && m.setSwapFree && m.setSwapTotal
+		m.setFree && m.setInactive && m.setSwapFree && m.setSwapTotal &&
+		(m.setAvailable || !available)
+}
+
+// availableBytes returns the available memory of the distribution,
+// limited to the total memory
+func (m *distribution) availableBytes() int64 {
+	available := m.free + m.buffers + m.cached
+	if m.setAvailable {
+		available = m.available
+	}
+	switch {
+	case available < 0:
+		return 0
+	case available > m.total:
+		return m.total
+	}
+	return available
+}
+
+// fill copies the values that are missing in m from prev
+func (m *distribution) fill(prev *distribution) {
+	if !m.setAvailable && prev.setAvailable {
+		m.available, m.setAvailable = prev.available, true
+	}
+	if !m.setTotal && prev.setTotal {
+		m.total, m.setTotal = prev.total, true
+	}
+	if !m.setActive && prev.setActive {
+		m.active, m.setActive = prev.active, true
+	}
+	if !m.setBuffers && prev.setBuffers {
+		m.buffers, m.setBuffers = prev.buffers, true
+	}
+	if !m.setCached && prev.setCached {
+		m.cached, m.setCached = prev.cached, true
+	}
+	if !m.setFree && prev.setFree {
+		m.free, m.setFree = prev.free, true
+	}
+	if !m.setInactive && prev.setInactive {
+		m.inactive, m.setInactive = prev.inactive, true
+	}
+	if !m.setSwapFree && prev.setSwapFree {
+		m.swapFree, m.setSwapFree = prev.swapFree, true
+	}
+	if !m.setSwapTotal && prev.setSwapTotal {
+		m.swapTotal, m.setSwapTotal = prev.swapTotal, true
+	}
+}
+
+// percent returns part as percentage of total
+func percent(part, total int64) float64 {
+	return round(float64(part)/float64(total)*100, .5, 2)
 }
 
 // https://gist.github.com/DavidVaini/10308388
@@ -0,0 +1,146 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package mem // import "github.com/solnx/hurricane/internal/mem"
+
+import (
+	"time"
+
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/reorder"
+)
+
+// state is the serializable form of Mem
+type state struct {
+	AssetID          int64             `json:"asset.id"`
+	Curr             distributionState `json:"curr"`
+	CurrTime         time.Time         `json:"curr.time"`
+	Buffer           []cycleState      `json:"buffer"`
+	Usage            float64           `json:"usage"`
+	ReportsAvailable bool              `json:"reports.available"`
+	Ack              []intf.Offset     `json:"ack"`
+}
+
+// cycleState is the serializable form of a reorder buffer entry
+type cycleState struct {
+	TS   time.Time         `json:"ts"`
+	Next distributionState `json:"next"`
+}
+
+// distributionState is the serializable form of distribution
+type distributionState struct {
+	SetAvailable bool  `json:"set.available"`
+	SetTotal     bool  `json:"set.total"`
+	SetActive    bool  `json:"set.active"`
+	SetBuffers   bool  `json:"set.buffers"`
+	SetCached    bool  `json:"set.cached"`
+	SetFree      bool  `json:"set.free"`
+	SetInactive  bool  `json:"set.inactive"`
+	SetSwapFree  bool  `json:"set.swapfree"`
+	SetSwapTotal bool  `json:"set.swaptotal"`
+	Available    int64 `json:"available"`
+	Total        int64 `json:"total"`
+	Active       int64 `json:"active"`
+	Buffers      int64 `json:"buffers"`
+	Cached       int64 `json:"cached"`
+	Free         int64 `json:"free"`
+	Inactive     int64 `json:"inactive"`
+	SwapFree     int64 `json:"swapfree"`
+	SwapTotal    int64 `json:"swaptotal"`
+}
+
+// export returns the serializable state of m. Outstanding
+// acknowledgements are exported as offsets.
+func (m *Mem) export() state {
+	s := state{
+		AssetID:          m.assetID,
+		Curr:             m.curr.export(),
+		CurrTime:         m.currTime,
+		Buffer:           []cycleState{},
+		Usage:            m.usage,
+		ReportsAvailable: m.reportsAvailable,
+		Ack:              append(intf.Offsets(m.outstanding()), m.pending...),
+	}
+	for _, e := range m.buffer.Entries() {
+		s.Buffer = append(s.Buffer, cycleState{
+			TS:   e.TS,
+			Next: e.Value.(*distribution).export(),
+		})
+	}
+	return s
+}
+
+// load sets m to the state s. The acknowledgements in s are stored
+// as pending until their messages are redelivered.
+func (m *Mem) load(s state) {
+	m.assetID = s.AssetID
+	m.curr = s.Curr.load()
+	m.currTime = s.CurrTime
+	for i := range s.Buffer {
+		next := s.Buffer[i].Next.load()
+		m.buffer.Insert(&reorder.Entry{
+			TS:    s.Buffer[i].TS,
+			Start: time.Now(),
+			Value: &next,
+		})
+	}
+	m.usage = s.Usage
+	m.reportsAvailable = s.ReportsAvailable
+	m.pending = s.Ack
+	m.lastSeen = time.Now()
+}
+
+// export returns the serializable state of d
+func (d *distribution) export() distributionState {
+	return distributionState{
+		SetAvailable: d.setAvailable,
+		SetTotal:     d.setTotal,
+		SetActive:    d.setActive,
+		SetBuffers:   d.setBuffers,
+		SetCached:    d.setCached,
+		SetFree:      d.setFree,
+		SetInactive:  d.setInactive,
+		SetSwapFree:  d.setSwapFree,
+		SetSwapTotal: d.setSwapTotal,
+		Available:    d.available,
+		Total:        d.total,
+		Active:       d.active,
+		Buffers:      d.buffers,
+		Cached:       d.cached,
+		Free:         d.free,
+		Inactive:     d.inactive,
+		SwapFree:     d.swapFree,
+		SwapTotal:    d.swapTotal,
+	}
+}
+
+// load returns the distribution described by s
+func (s distributionState) load() distribution {
+	return distribution{
+		setAvailable: s.SetAvailable,
+		setTotal:     s.SetTotal,
+		setActive:    s.SetActive,
+		setBuffers:   s.SetBuffers,
+		setCached:    s.SetCached,
+		setFree:      s.SetFree,
+		setInactive:  s.SetInactive,
+		setSwapFree:  s.SetSwapFree,
+		setSwapTotal: s.SetSwapTotal,
+		available:    s.Available,
+		total:        s.Total,
+		active:       s.Active,
+		buffers:      s.Buffers,
+		cached:       s.Cached,
+		free:         s.Free,
+		inactive:     s.Inactive,
+		swapFree:     s.SwapFree,
+		swapTotal:    s.SwapTotal,
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -9,27 +9,60 @@
 package netif // import "github.com/solnx/hurricane/internal/netif"
 
 import (
+	"encoding/json"
+	"time"
+
 	"github.com/mjolnir42/erebos"
-	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/hurricane/internal/config"
 	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/registry"
+	"github.com/solnx/hurricane/internal/reorder"
+	"github.com/solnx/hurricane/internal/rollup"
 	"github.com/solnx/legacy"
 )
 
 // Implementation of the intf.Deriver interface
 
-// NewDeriver returns a new Deriver
-func NewDeriver(conf *erebos.Config) *Deriver {
+func init() {
+	registry.Register(`netif`, func(conf *erebos.Config, settings *config.Config, lookup intf.TagLookup) (intf.Deriver, error) {
+		d, err := NewDeriver(lookup, settings.Deriver(`netif`))
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	})
+}
+
+// NewDeriver returns a new Deriver. It returns an error if an option
+// in settings is invalid.
+func NewDeriver(lookup intf.TagLookup, settings config.Deriver) (*Deriver, error) {
 	d := &Deriver{}
 	d.data = make(map[int64]map[string]*netIf)
-	d.lookup = wall.NewLookup(conf, `hurricane`)
-	return d
+	d.lookup = lookup
+	d.window = time.Duration(settings.ReorderWindow) * time.Second
+	d.cycles = settings.ReorderCycles
+	d.totals = make(map[int64]*rollup.Rollup)
+
+	var err error
+	if d.overrides, err = speedOverrides(settings); err != nil {
+		return nil, err
+	}
+	if d.exclude, err = rollupExclude(settings); err != nil {
+		return nil, err
+	}
+	return d, nil
 }
 
 // Deriver holds the metric distributions used to calculate derived
 // network interface metrics
 type Deriver struct {
-	data   map[int64]map[string]*netIf
-	lookup *wall.Lookup
+	data      map[int64]map[string]*netIf
+	lookup    intf.TagLookup
+	window    time.Duration
+	cycles    int
+	overrides overrides
+	exclude   rollup.Exclude
+	totals    map[int64]*rollup.Rollup
 }
 
 // Start activates the embedded cache lookup in d
@@ -50,6 +83,11 @@ func (d *Deriver) Register(m map[string]intf.Deriver) {
 		`/sys/net/rx_bytes`,
 		`/sys/net/rx_packets`,
 		`/sys/net/speed`,
+		`/sys/net/rx_errors`,
+		`/sys/net/tx_errors`,
+		`/sys/net/rx_dropped`,
+		`/sys/net/tx_dropped`,
+		`/sys/net/collisions`,
 	} {
 		m[s] = d
 	}
@@ -74,11 +112,102 @@ func (d *Deriver) Update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.
 
 	if _, ok := d.data[m.AssetID][intf]; !ok {
 		d.data[m.AssetID][intf] = &netIf{
-			lookup: d.lookup,
+			lookup:    d.lookup,
+			buffer:    reorder.New(d.window, d.cycles),
+			overrides: d.overrides,
+			report:    d.reporter(m.AssetID, intf),
 		}
 	}
 
 	return d.data[m.AssetID][intf].update(m, t)
 }
 
+// Snapshot returns the serialized state of d
+func (d *Deriver) Snapshot() ([]byte, error) {
+	s := make(map[int64]map[string]state, len(d.data))
+	for assetID := range d.data {
+		s[assetID] = make(map[string]state, len(d.data[assetID]))
+		for dev := range d.data[assetID] {
+			s[assetID][dev] = d.data[assetID][dev].export()
+		}
+	}
+	return json.Marshal(s)
+}
+
+// Restore loads the state serialized by Snapshot into d
+func (d *Deriver) Restore(b []byte) error {
+	s := make(map[int64]map[string]state)
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	for assetID := range s {
+		if _, ok := d.data[assetID]; !ok {
+			d.data[assetID] = make(map[string]*netIf)
+		}
+		for dev := range s[assetID] {
+			d.data[assetID][dev] = &netIf{
+				lookup:    d.lookup,
+				buffer:    reorder.New(d.window, d.cycles),
+				overrides: d.overrides,
+				report:    d.reporter(assetID, dev),
+			}
+			d.data[assetID][dev].load(s[assetID][dev])
+		}
+	}
+	return nil
+}
+
+// Evict removes all interfaces from d that have not been updated since
+// deadline
+func (d *Deriver) Evict(deadline time.Time) ([]*erebos.Transport, int) {
+	acks := []*erebos.Transport{}
+	var evicted int
+	for assetID := range d.data {
+		for dev := range d.data[assetID] {
+			if d.data[assetID][dev].lastSeen.Before(deadline) {
+				acks = append(acks, d.data[assetID][dev].outstanding()...)
+				delete(d.data[assetID], dev)
+				evicted++
+			}
+		}
+		if len(d.data[assetID]) == 0 {
+			delete(d.data, assetID)
+			delete(d.totals, assetID)
+		}
+	}
+	return acks, evicted
+}
+
+// Drop removes all interfaces of assetID from d
+func (d *Deriver) Drop(assetID int64) []*erebos.Transport {
+	acks := []*erebos.Transport{}
+	for dev := range d.data[assetID] {
+		acks = append(acks, d.data[assetID][dev].outstanding()...)
+	}
+	delete(d.data, assetID)
+	delete(d.totals, assetID)
+	return acks
+}
+
+// Expire ends all distributions in d that have not been completed
+// before deadline
+func (d *Deriver) Expire(deadline time.Time, partial bool) ([]*legacy.MetricSplit, []*erebos.Transport, int, int, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var dropped, evaluated int
+	for assetID := range d.data {
+		for dev := range d.data[assetID] {
+			m, a, drp, evl, err := d.data[assetID][dev].expire(deadline, partial)
+			if err != nil {
+				return nil, nil, 0, 0, err
+			}
+			derived = append(derived, m...)
+			acks = append(acks, a...)
+			dropped += drp
+			evaluated += evl
+		}
+	}
+	return derived, acks, dropped, evaluated, nil
+}
+
 // vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,124 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package netif // import "github.com/solnx/hurricane/internal/netif"
+
+import (
+	"testing"
+
+	"github.com/solnx/hurricane/internal/config"
+	"github.com/solnx/hurricane/internal/derivertest"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/lookup"
+)
+
+func TestGolden(t *testing.T) {
+	derivertest.Suite(t, `testdata`, func(lookup intf.TagLookup) intf.Deriver {
+		d, err := NewDeriver(lookup, config.Deriver{
+			ReorderCycles: 2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
+
+func TestGoldenOptions(t *testing.T) {
+	derivertest.Suite(t, `testdata/options`, func(lookup intf.TagLookup) intf.Deriver {
+		d, err := NewDeriver(lookup, config.Deriver{
+			ReorderCycles: 2,
+			Options: map[string]string{
+				`speed.override.veth*`:  `10000`,
+				`speed.override.veth9`:  `0`,
+				`speed.override.dummy*`: `1000`,
+				`rollup.exclude`:        `docker*, virbr*`,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
+
+func TestSpeedOverrides(t *testing.T) {
+	for _, test := range []struct {
+		option string
+		value  string
+		valid  bool
+	}{
+		{`speed.override.eth*`, `40000`, true},
+		{`speed.override.bond0`, `0`, true},
+		{`speed.override.eth[`, `1000`, false},
+		{`speed.override.`, `1000`, false},
+		{`speed.override.eth*`, `-1`, false},
+		{`speed.override.eth*`, `fast`, false},
+	} {
+		_, err := speedOverrides(config.Deriver{
+			Options: map[string]string{test.option: test.value},
+		})
+		if (err == nil) != test.valid {
+			t.Errorf("option %s: %s, valid %t, got error %v",
+				test.option, test.value, test.valid, err)
+		}
+	}
+}
+
+// TestLegacyLinkLimits checks that the limits of the Ethernet types
+// of the former fixed table are unchanged
+func TestLegacyLinkLimits(t *testing.T) {
+	for _, test := range []struct {
+		speed int64
+		fps   int64
+	}{
+		{10, 14880},
+		{100, 148809},
+		{1000, 1488096},
+		{10000, 14880952},
+		{100000, 148809524},
+	} {
+		bps, fps, ok := linkLimits(test.speed)
+		if !ok || bps != test.speed*1000000 || fps != test.fps {
+			t.Errorf("speed %d: got %d bps, %d fps, expected %d, %d",
+				test.speed, bps, fps, test.speed*1000000, test.fps)
+		}
+	}
+}
+
+func TestLinkLimits(t *testing.T) {
+	for _, test := range []struct {
+		speed int64
+		bps   int64
+		fps   int64
+	}{
+		{25000, 25000000000, 37202380},
+		{40000, 40000000000, 59523809},
+		{400000, 400000000000, 595238095},
+	} {
+		bps, fps, ok := linkLimits(test.speed)
+		if !ok || bps != test.bps || fps != test.fps {
+			t.Errorf("speed %d: got %d bps, %d fps, expected %d, %d",
+				test.speed, bps, fps, test.bps, test.fps)
+		}
+	}
+	if _, _, ok := linkLimits(-1); ok {
+		t.Error(`unknown speed has limits`)
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	derivertest.InvalidOptions(t, func(settings config.Deriver) error {
+		_, err := NewDeriver(lookup.NewMemory(), settings)
+		return err
+	}, append([]derivertest.Option{
+		{Name: `speed.override.eth[`, Value: `1000`},
+	}, derivertest.InvalidRollupOptions...))
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
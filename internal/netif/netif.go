@@ -18,6 +18,32 @@
 //	- net.tx.packet.rate.utilization.percent:%dev
 //	- net.tx.packets.per.second:%dev
 //	- net.utilization.percent:%dev
+//	- net.rx.errors.per.second:%dev
+//	- net.tx.errors.per.second:%dev
+//	- net.rx.dropped.per.second:%dev
+//	- net.tx.dropped.per.second:%dev
+//	- net.collisions.per.second:%dev
+//	- net.rx.error.percent:%dev
+//	- net.tx.error.percent:%dev
+//
+// The rx_errors, tx_errors, rx_dropped, tx_dropped and collisions
+// counters are optional. Once they have been seen for an interface,
+// they are required for its distributions to be complete. Their rates
+// are only derived for interfaces that report them. The error percent
+// is the share of errors in all packets and errors of a direction.
+//
+// Utilizations are derived from the maximum bit and frame rate of an
+// Ethernet link with the reported speed. The deriver options
+// speed.override.<pattern> set the speed in Mbit/s of the interfaces
+// whose name matches the shell pattern, 0 disables their
+// utilizations.
+//
+// The per asset totals net.rx.bytes.per.second and
+// net.tx.bytes.per.second are derived once all interfaces of an asset
+// with a known speed have been derived for a measurement cycle. The
+// loopback interface and the interfaces matching the comma separated
+// shell patterns of the deriver option rollup.exclude are not part of
+// the totals.
 package netif // import "github.com/solnx/hurricane/internal/netif"
 
 import (
@@ -28,57 +54,12 @@ import (
 	"time"
 
 	"github.com/mjolnir42/erebos"
-	wall "github.com/solnx/eye/lib/eye.wall"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/numeric"
+	"github.com/solnx/hurricane/internal/reorder"
 	"github.com/solnx/legacy"
 )
 
-// deviceAttributes contains Ethernet characteristics needed for
-// utilization calculation
-var deviceAttributes map[int64]map[string]int64
-
-const (
-	// maximum frame per second constants for differrent Ethernet types
-	maxFPS10MbE  = 14880
-	maxFPS100MbE = 148809
-	maxFPS1GbE   = 1488096
-	maxFPS10GbE  = 14880952
-	maxFPS100GbE = 148809524
-	// maximum bit per second constants for different Ethernet types
-	maxBitPS10MbE  = 10000000
-	maxBitPS100MbE = 100000000
-	maxBitPS1GbE   = 1000000000
-	maxBitPS10GbE  = 10000000000
-	maxBitPS100GbE = 100000000000
-	// makes it obvious during calculation what conversion is being
-	// applied
-	bitsPerByte = 8
-)
-
-func init() {
-	deviceAttributes = map[int64]map[string]int64{
-		10: map[string]int64{
-			`fps`: maxFPS10MbE,
-			`bps`: maxBitPS10MbE,
-		},
-		100: map[string]int64{
-			`fps`: maxFPS100MbE,
-			`bps`: maxBitPS100MbE,
-		},
-		1000: map[string]int64{
-			`fps`: maxFPS1GbE,
-			`bps`: maxBitPS1GbE,
-		},
-		10000: map[string]int64{
-			`fps`: maxFPS10GbE,
-			`bps`: maxBitPS10GbE,
-		},
-		100000: map[string]int64{
-			`fps`: maxFPS100GbE,
-			`bps`: maxBitPS100GbE,
-		},
-	}
-}
-
 // netIf implements the logic to compute derived network interface
 // metrics
 type netIf struct {
@@ -100,12 +81,21 @@ type netIf struct {
 	rxUtilizationPPS float64
 	txUtilizationPPS float64
 	utilization      float64 // net.utilization.percent:%dev
-	lookup           *wall.Lookup
+	optional         optional
+	overrides        overrides
+	report           reportFunc
+	lookup           intf.TagLookup
 	ack              []*erebos.Transport
+	pending          []intf.Offset
+	lastSeen         time.Time
+	buffer           *reorder.Buffer
 }
 
 // Update adds m to the next distribution tracked by netIf
 func (n *netIf) update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	// track activity for the eviction of idle state
+	n.lastSeen = time.Now()
+
 	// set assetID on first use
 	if n.assetID == 0 {
 		n.assetID = m.AssetID
@@ -126,58 +116,123 @@ func (n *netIf) update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.Me
 		return []*legacy.MetricSplit{}, []*erebos.Transport{t}, true, nil
 	}
 
-processing:
-	// first metric for this distribution
-	if n.nextTime.IsZero() {
-		n.nextTime = m.TS
+	// redelivery of a message that is part of the restored state
+	pending, claimed := intf.Claim(n.pending, t)
+	n.pending = pending
+	if claimed {
+		n.ack = append(n.ack, t)
+		return nil, nil, false, nil
+	}
+
+	value, err := numeric.Int64(m)
+	if err != nil {
+		return nil, nil, false, err
 	}
 
-	// out of order metric for old timestamp
-	if n.nextTime.After(m.TS) {
+	// optional counters are required once a valid value has been seen
+	switch m.Path {
+	case `/sys/net/rx_errors`:
+		n.optional.rxErrors = true
+	case `/sys/net/tx_errors`:
+		n.optional.txErrors = true
+	case `/sys/net/rx_dropped`:
+		n.optional.rxDropped = true
+	case `/sys/net/tx_dropped`:
+		n.optional.txDropped = true
+	case `/sys/net/collisions`:
+		n.optional.collisions = true
+	}
+
+	// metric for a measurement cycle that was already evaluated
+	if !n.currTime.IsZero() && !m.TS.After(n.currTime) {
 		return []*legacy.MetricSplit{}, []*erebos.Transport{t}, true, nil
 	}
 
-	// abandon current next and start new one
-	if n.nextTime.Before(m.TS) {
-		n.nextTime = time.Time{}
-		n.next = distribution{}
-		goto processing
-	}
-
-	if n.nextTime.Equal(m.TS) {
-		switch m.Path {
-		case `/sys/net/tx_bytes`:
-			n.next.txBytes = m.Value().(int64)
-			n.next.setTxBytes = true
-		case `/sys/net/rx_bytes`:
-			n.next.rxBytes = m.Value().(int64)
-			n.next.setRxBytes = true
-		case `/sys/net/tx_packets`:
-			n.next.txPackets = m.Value().(int64)
-			n.next.setTxPackets = true
-		case `/sys/net/rx_packets`:
-			n.next.rxPackets = m.Value().(int64)
-			n.next.setRxPackets = true
-		case `/sys/net/speed`:
-			n.speed = m.Value().(int64)
-		}
+	e := n.buffer.Get(m.TS, func() interface{} {
+		return &distribution{}
+	})
+	next := e.Value.(*distribution)
+	switch m.Path {
+	case `/sys/net/tx_bytes`:
+		next.txBytes = value
+		next.setTxBytes = true
+	case `/sys/net/rx_bytes`:
+		next.rxBytes = value
+		next.setRxBytes = true
+	case `/sys/net/tx_packets`:
+		next.txPackets = value
+		next.setTxPackets = true
+	case `/sys/net/rx_packets`:
+		next.rxPackets = value
+		next.setRxPackets = true
+	case `/sys/net/rx_errors`:
+		next.rxErrors = value
+		next.setRxErrors = true
+	case `/sys/net/tx_errors`:
+		next.txErrors = value
+		next.setTxErrors = true
+	case `/sys/net/rx_dropped`:
+		next.rxDropped = value
+		next.setRxDropped = true
+	case `/sys/net/tx_dropped`:
+		next.txDropped = value
+		next.setTxDropped = true
+	case `/sys/net/collisions`:
+		next.collisions = value
+		next.setCollisions = true
+	case `/sys/net/speed`:
+		n.speed = value
+	}
+	e.Acks = append(e.Acks, t)
+
+	// distributions that fell out of the reorder window are abandoned
+	abandoned := n.buffer.Trim()
+
+	derived, acks, ok, err := n.evaluate()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if len(abandoned) > 0 {
+		return derived, append(acks, abandoned...), true, nil
 	}
+	return derived, acks, ok, nil
+}
 
-	n.ack = append(n.ack, t)
-	return n.calculate()
+// evaluate calculates the derived metrics for all complete distributions at
+// the start of the reorder buffer in timestamp order. Evaluation stops
+// at the first incomplete distribution.
+func (n *netIf) evaluate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var ok bool
+
+	for e := n.buffer.Oldest(); e != nil && e.Value.(*distribution).valid(n.optional) && n.speedKnown(); e = n.buffer.Oldest() {
+		n.buffer.Pop()
+		n.next = *e.Value.(*distribution)
+		n.nextTime = e.TS
+		n.ack = append(n.ack, e.Acks...)
+
+		m, a, done, err := n.calculate()
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if done {
+			derived = append(derived, m...)
+			acks = append(acks, a...)
+			ok = true
+		}
+	}
+	return derived, acks, ok, nil
 }
 
 // calculate checks if the next counter has been fully assembled and
 // then calculates the derived metrics, moves the counters forward and
 // returns the derived metrics. If the next counter is not yet complete,
-// it returns nil.
+// it returns nil. Utilizations are only calculated if the speed of the
+// interface is known.
 func (n *netIf) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
 
-	if n.speed == 0 {
-		return nil, nil, false, nil
-	}
-
-	if n.nextTime.IsZero() || !n.next.valid() {
+	if n.nextTime.IsZero() || !n.next.valid(n.optional) {
 		return nil, nil, false, nil
 	}
 
@@ -207,8 +262,12 @@ func (n *netIf) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, e
 	rxPackets := n.next.rxPackets - n.curr.rxPackets
 	txPackets := n.next.txPackets - n.curr.txPackets
 
+	// calculate the rates of the optional counters
+	rates, wrapped := n.counterRates(deltaSeconds, rxPackets, txPackets)
+
 	// check for counter wrap
-	if rxBytes < 0 || txBytes < 0 || rxPackets < 0 || txPackets < 0 {
+	if rxBytes < 0 || txBytes < 0 || rxPackets < 0 || txPackets < 0 ||
+		wrapped {
 		n.nextToCurrent()
 		return nil, nil, false, nil
 	}
@@ -238,11 +297,11 @@ func (n *netIf) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, e
 	n.txPPS = float64(txPackets) / deltaSeconds
 
 	// only calculate utilizations if the device attributes are known
-	if _, ok := deviceAttributes[n.speed]; ok && n.intf != `lo` {
+	if maxBPS, maxFPS, ok := n.limits(); ok {
 		// calculate incoming bandwidth utilization
 		rxUtilizationBPS := big.NewRat(0, 1).SetFrac64(
 			int64(n.rxBPS)*bitsPerByte,
-			deviceAttributes[n.speed][`bps`],
+			maxBPS,
 		)
 		rxUtilizationBPS.Mul(rxUtilizationBPS, big.NewRat(100, 1))
 		n.rxUtilizationBPS, _ = strconv.ParseFloat(rxUtilizationBPS.FloatString(2), 64)
@@ -251,7 +310,7 @@ func (n *netIf) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, e
 		// calculate outgoing bandwidth utilization
 		txUtilizationBPS := big.NewRat(0, 1).SetFrac64(
 			int64(n.txBPS)*bitsPerByte,
-			deviceAttributes[n.speed][`bps`],
+			maxBPS,
 		)
 		txUtilizationBPS.Mul(txUtilizationBPS, big.NewRat(100, 1))
 		n.txUtilizationBPS, _ = strconv.ParseFloat(txUtilizationBPS.FloatString(2), 64)
@@ -260,7 +319,7 @@ func (n *netIf) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, e
 		// calculate incoming packet rate utilization
 		rxUtilizationPPS := big.NewRat(0, 1).SetFrac64(
 			int64(n.rxPPS),
-			deviceAttributes[n.speed][`fps`],
+			maxFPS,
 		)
 		rxUtilizationPPS.Mul(rxUtilizationPPS, big.NewRat(100, 1))
 		n.rxUtilizationPPS, _ = strconv.ParseFloat(rxUtilizationPPS.FloatString(2), 64)
@@ -269,7 +328,7 @@ func (n *netIf) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, e
 		// calculate outgoing packet rate utilization
 		txUtilizationPPS := big.NewRat(0, 1).SetFrac64(
 			int64(n.txPPS),
-			deviceAttributes[n.speed][`fps`],
+			maxFPS,
 		)
 		txUtilizationPPS.Mul(txUtilizationPPS, big.NewRat(100, 1))
 		n.txUtilizationPPS, _ = strconv.ParseFloat(txUtilizationPPS.FloatString(2), 64)
@@ -290,15 +349,157 @@ func (n *netIf) calculate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, e
 	n.txPPS = round(n.txPPS, .5, 2)
 
 	n.nextToCurrent()
-	derived, err := n.emitMetric()
+	derived, err := n.emitMetric(rates)
 	if err != nil {
 		return nil, nil, false, err
 	}
+	if n.report != nil {
+		totals, err := n.report(n.currTime, n.rxBPS, n.txBPS)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		derived = append(derived, totals...)
+	}
 	acks := n.ack
 	n.ack = []*erebos.Transport{}
 	return derived, acks, true, nil
 }
 
+// speedKnown checks if the speed of the interface is known, either
+// reported or overridden
+func (n *netIf) speedKnown() bool {
+	if _, ok := n.overrides.match(n.intf); ok {
+		return true
+	}
+	return n.speed != 0
+}
+
+// limits returns the maximum bit rate and frame rate per second of the
+// interface. The speed is taken from the configured overrides before
+// the reported speed. It returns false if the utilizations can not be
+// calculated for the interface.
+func (n *netIf) limits() (int64, int64, bool) {
+	if n.intf == `lo` {
+		return 0, 0, false
+	}
+	speed, ok := n.overrides.match(n.intf)
+	if !ok {
+		speed = n.speed
+	}
+	return linkLimits(speed)
+}
+
+// counterRates calculates the rates of the optional counters that are
+// reported by the current and the next distribution, which are
+// deltaSeconds apart. The error percents are calculated relative to the
+// rxPackets and txPackets received and sent in that time. It returns
+// true if one of the counters wrapped.
+func (n *netIf) counterRates(deltaSeconds float64, rxPackets, txPackets int64) ([]counterRate, bool) {
+	rates := []counterRate{}
+	for _, c := range []struct {
+		name    string
+		ok      bool
+		curr    int64
+		next    int64
+		share   string
+		packets int64
+	}{
+		{`net.rx.errors.per.second`, n.curr.setRxErrors && n.next.setRxErrors,
+			n.curr.rxErrors, n.next.rxErrors, `net.rx.error.percent`, rxPackets},
+		{`net.tx.errors.per.second`, n.curr.setTxErrors && n.next.setTxErrors,
+			n.curr.txErrors, n.next.txErrors, `net.tx.error.percent`, txPackets},
+		{`net.rx.dropped.per.second`, n.curr.setRxDropped && n.next.setRxDropped,
+			n.curr.rxDropped, n.next.rxDropped, ``, 0},
+		{`net.tx.dropped.per.second`, n.curr.setTxDropped && n.next.setTxDropped,
+			n.curr.txDropped, n.next.txDropped, ``, 0},
+		{`net.collisions.per.second`, n.curr.setCollisions && n.next.setCollisions,
+			n.curr.collisions, n.next.collisions, ``, 0},
+	} {
+		if !c.ok {
+			continue
+		}
+		delta := c.next - c.curr
+		if delta < 0 {
+			return nil, true
+		}
+		rates = append(rates, counterRate{
+			name:  c.name,
+			unit:  `#`,
+			value: round(float64(delta)/deltaSeconds, .5, 2),
+		})
+		if c.share == `` {
+			continue
+		}
+		var share float64
+		if delta+c.packets > 0 {
+			share = float64(delta) / float64(delta+c.packets) * 100
+		}
+		rates = append(rates, counterRate{
+			name:  c.share,
+			unit:  `%`,
+			value: round(share, .5, 2),
+		})
+	}
+	return rates, false
+}
+
+// expire gives up on all distributions in the reorder buffer that were
+// started before deadline and are still incomplete. If partial is
+// set, missing values are carried over from the current distribution and
+// the result is evaluated. Otherwise, or if the result can still not
+// be evaluated, the distribution is dropped and its acknowledgements are
+// released. Complete distributions that were waiting for the expired ones
+// are evaluated afterwards. It returns the number of dropped and
+// partially evaluated distributions.
+func (n *netIf) expire(deadline time.Time, partial bool) ([]*legacy.MetricSplit, []*erebos.Transport, int, int, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var dropped, evaluated int
+
+	for e := n.buffer.Oldest(); e != nil && e.Start.Before(deadline); e = n.buffer.Oldest() {
+		n.buffer.Pop()
+		next := e.Value.(*distribution)
+		// without the interface speed only the rates can be evaluated
+		ready := next.valid(n.optional) && n.speedKnown()
+		if !ready && partial && !n.currTime.IsZero() {
+			next.fill(&n.curr)
+			if ready = next.valid(n.optional); ready {
+				evaluated++
+			}
+		}
+		if !ready {
+			acks = append(acks, e.Acks...)
+			dropped++
+			continue
+		}
+
+		n.next = *next
+		n.nextTime = e.TS
+		n.ack = append(n.ack, e.Acks...)
+		m, a, ok, err := n.calculate()
+		if err != nil {
+			return nil, nil, 0, 0, err
+		}
+		if ok {
+			derived = append(derived, m...)
+			acks = append(acks, a...)
+		}
+	}
+
+	m, a, _, err := n.evaluate()
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	derived = append(derived, m...)
+	acks = append(acks, a...)
+	return derived, acks, dropped, evaluated, nil
+}
+
+// outstanding returns all acknowledgements held by n
+func (n *netIf) outstanding() []*erebos.Transport {
+	return append(n.buffer.Acks(), n.ack...)
+}
+
 // nextToCurrent advances the distributions within netIf by one step
 func (n *netIf) nextToCurrent() {
 	n.currTime = n.nextTime
@@ -308,8 +509,9 @@ func (n *netIf) nextToCurrent() {
 	n.next = distribution{}
 }
 
-// emitMetric returns the derived metrics for the current counter
-func (n *netIf) emitMetric() ([]*legacy.MetricSplit, error) {
+// emitMetric returns the derived metrics for the current counter,
+// including the rates of the optional counters
+func (n *netIf) emitMetric(rates []counterRate) ([]*legacy.MetricSplit, error) {
 	nRxBPS := &legacy.MetricSplit{
 		AssetID: n.assetID,
 		Path:    fmt.Sprintf("net.rx.bytes.per.second:%s", n.intf),
@@ -320,15 +522,6 @@ func (n *netIf) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: n.rxBPS,
 		},
 	}
-	if tags, err := n.lookup.GetConfigurationID(
-		nRxBPS.LookupID(),
-	); err == nil {
-		// there are checks for this metric
-		nRxBPS.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		// do not emit potentially incorrect metrics
-		return []*legacy.MetricSplit{}, err
-	}
 
 	nTxBPS := &legacy.MetricSplit{
 		AssetID: n.assetID,
@@ -340,13 +533,6 @@ func (n *netIf) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: n.txBPS,
 		},
 	}
-	if tags, err := n.lookup.GetConfigurationID(
-		nTxBPS.LookupID(),
-	); err == nil {
-		nTxBPS.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		return []*legacy.MetricSplit{}, err
-	}
 
 	nRxPPS := &legacy.MetricSplit{
 		AssetID: n.assetID,
@@ -358,13 +544,6 @@ func (n *netIf) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: n.rxPPS,
 		},
 	}
-	if tags, err := n.lookup.GetConfigurationID(
-		nRxPPS.LookupID(),
-	); err == nil {
-		nRxPPS.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		return []*legacy.MetricSplit{}, err
-	}
 
 	nTxPPS := &legacy.MetricSplit{
 		AssetID: n.assetID,
@@ -376,13 +555,6 @@ func (n *netIf) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: n.txPPS,
 		},
 	}
-	if tags, err := n.lookup.GetConfigurationID(
-		nTxPPS.LookupID(),
-	); err == nil {
-		nTxPPS.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		return []*legacy.MetricSplit{}, err
-	}
 
 	nRxSize := &legacy.MetricSplit{
 		AssetID: n.assetID,
@@ -394,13 +566,6 @@ func (n *netIf) emitMetric() ([]*legacy.MetricSplit, error) {
 			IntVal: n.rxSize,
 		},
 	}
-	if tags, err := n.lookup.GetConfigurationID(
-		nRxSize.LookupID(),
-	); err == nil {
-		nRxSize.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		return []*legacy.MetricSplit{}, err
-	}
 
 	nTxSize := &legacy.MetricSplit{
 		AssetID: n.assetID,
@@ -412,18 +577,27 @@ func (n *netIf) emitMetric() ([]*legacy.MetricSplit, error) {
 			IntVal: n.txSize,
 		},
 	}
-	if tags, err := n.lookup.GetConfigurationID(
-		nTxSize.LookupID(),
-	); err == nil {
-		nTxSize.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		return []*legacy.MetricSplit{}, err
-	}
 
 	result := []*legacy.MetricSplit{nRxBPS, nTxBPS, nRxPPS, nTxPPS, nRxSize, nTxSize}
+	for i := range rates {
+		result = append(result, &legacy.MetricSplit{
+			AssetID: n.assetID,
+			Path:    fmt.Sprintf("%s:%s", rates[i].name, n.intf),
+			TS:      n.currTime,
+			Type:    `real`,
+			Unit:    rates[i].unit,
+			Val: legacy.MetricValue{
+				FlpVal: rates[i].value,
+			},
+		})
+	}
 
 	// return result if utilizations have not been calculated
-	if _, ok := deviceAttributes[n.speed]; !ok || n.intf == `lo` {
+	if _, _, ok := n.limits(); !ok {
+		if err := intf.LookupTags(n.lookup, result); err != nil {
+			// do not emit potentially incorrect metrics
+			return []*legacy.MetricSplit{}, err
+		}
 		return result, nil
 	}
 
@@ -437,13 +611,6 @@ func (n *netIf) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: n.rxUtilizationBPS,
 		},
 	}
-	if tags, err := n.lookup.GetConfigurationID(
-		nRxUtilBPS.LookupID(),
-	); err == nil {
-		nRxUtilBPS.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		return []*legacy.MetricSplit{}, err
-	}
 
 	nTxUtilBPS := &legacy.MetricSplit{
 		AssetID: n.assetID,
@@ -455,13 +622,6 @@ func (n *netIf) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: n.txUtilizationBPS,
 		},
 	}
-	if tags, err := n.lookup.GetConfigurationID(
-		nTxUtilBPS.LookupID(),
-	); err == nil {
-		nTxUtilBPS.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		return []*legacy.MetricSplit{}, err
-	}
 
 	nRxUtilPPS := &legacy.MetricSplit{
 		AssetID: n.assetID,
@@ -473,13 +633,6 @@ func (n *netIf) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: n.rxUtilizationPPS,
 		},
 	}
-	if tags, err := n.lookup.GetConfigurationID(
-		nRxUtilPPS.LookupID(),
-	); err == nil {
-		nRxUtilPPS.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		return []*legacy.MetricSplit{}, err
-	}
 
 	nTxUtilPPS := &legacy.MetricSplit{
 		AssetID: n.assetID,
@@ -491,13 +644,6 @@ func (n *netIf) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: n.txUtilizationPPS,
 		},
 	}
-	if tags, err := n.lookup.GetConfigurationID(
-		nTxUtilPPS.LookupID(),
-	); err == nil {
-		nTxUtilPPS.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		return []*legacy.MetricSplit{}, err
-	}
 
 	nUtilization := &legacy.MetricSplit{
 		AssetID: n.assetID,
@@ -509,34 +655,95 @@ func (n *netIf) emitMetric() ([]*legacy.MetricSplit, error) {
 			FlpVal: n.utilization,
 		},
 	}
-	if tags, err := n.lookup.GetConfigurationID(
-		nUtilization.LookupID(),
-	); err == nil {
-		nUtilization.Tags = tags
-	} else if err != wall.ErrUnconfigured {
-		return []*legacy.MetricSplit{}, err
-	}
 
 	result = append(result, nRxUtilBPS, nTxUtilBPS, nRxUtilPPS, nTxUtilPPS, nUtilization)
+	if err := intf.LookupTags(n.lookup, result); err != nil {
+		// do not emit potentially incorrect metrics
+		return []*legacy.MetricSplit{}, err
+	}
 	return result, nil
 }
 
+// counterRate is a rate or share derived from an optional counter
+type counterRate struct {
+	name  string
+	unit  string
+	value float64
+}
+
+// optional records which optional counters are reported for an
+// interface
+type optional struct {
+	rxErrors   bool
+	txErrors   bool
+	rxDropped  bool
+	txDropped  bool
+	collisions bool
+}
+
 // distribution is used to track multiple network metrics from the same
 // measurement cycle
 type distribution struct {
-	setRxBytes   bool
-	setRxPackets bool
-	setTxBytes   bool
-	setTxPackets bool
-	rxBytes      int64
-	rxPackets    int64
-	txBytes      int64
-	txPackets    int64
+	setRxBytes    bool
+	setRxPackets  bool
+	setTxBytes    bool
+	setTxPackets  bool
+	setRxErrors   bool
+	setTxErrors   bool
+	setRxDropped  bool
+	setTxDropped  bool
+	setCollisions bool
+	rxBytes       int64
+	rxPackets     int64
+	txBytes       int64
+	txPackets     int64
+	rxErrors      int64
+	txErrors      int64
+	rxDropped     int64
+	txDropped     int64
+	collisions    int64
+}
+
+// valid checks if a distribution has been fully populated, including
+// the optional counters reported for the interface
+func (d *distribution) valid(o optional) bool {
+	return d.setRxBytes && d.setRxPackets && d.setTxBytes &&
+		d.setTxPackets && (d.setRxErrors || !o.rxErrors) &&
+		(d.setTxErrors || !o.txErrors) &&
+		(d.setRxDropped || !o.rxDropped) &&
+		(d.setTxDropped || !o.txDropped) &&
+		(d.setCollisions || !o.collisions)
 }
 
-// valid checks if a distribution has been fully populated
-func (d *distribution) valid() bool {
-	return d.setRxBytes && d.setRxPackets && d.setTxBytes && d.setTxPackets
+// fill copies the values that are missing in d from prev
+func (d *distribution) fill(prev *distribution) {
+	if !d.setRxBytes && prev.setRxBytes {
+		d.rxBytes, d.setRxBytes = prev.rxBytes, true
+	}
+	if !d.setRxPackets && prev.setRxPackets {
+		d.rxPackets, d.setRxPackets = prev.rxPackets, true
+	}
+	if !d.setTxBytes && prev.setTxBytes {
+		d.txBytes, d.setTxBytes = prev.txBytes, true
+	}
+	if !d.setTxPackets && prev.setTxPackets {
+		d.txPackets, d.setTxPackets = prev.txPackets, true
+	}
+	if !d.setRxErrors && prev.setRxErrors {
+		d.rxErrors, d.setRxErrors = prev.rxErrors, true
+	}
+	if !d.setTxErrors && prev.setTxErrors {
+		d.txErrors, d.setTxErrors = prev.txErrors, true
+	}
+	if !d.setRxDropped && prev.setRxDropped {
+		d.rxDropped, d.setRxDropped = prev.rxDropped, true
+	}
+	if !d.setTxDropped && prev.setTxDropped {
+		d.txDropped, d.setTxDropped = prev.txDropped, true
+	}
+	if !d.setCollisions && prev.setCollisions {
+		d.collisions, d.setCollisions = prev.collisions, true
+	}
 }
 
 // https://gist.github.com/DavidVaini/10308388
@@ -0,0 +1,125 @@
+/*-
+ * Copyright © 2018, 1&1 Internet SE
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package netif // import "github.com/solnx/hurricane/internal/netif"
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/solnx/hurricane/internal/config"
+)
+
+const (
+	// prefix of the options that override the speed of the
+	// interfaces matching the rest of the option name
+	optionSpeed = `speed.override.`
+	// makes it obvious during calculation what conversion is being
+	// applied
+	bitsPerByte = 8
+	// bits per second in one Mbit/s, the unit of the interface speed
+	bitsPerMbit = 1000000
+	// a minimum size Ethernet frame of 64 bytes occupies the wire
+	// for additional 8 bytes of preamble and start of frame delimiter
+	// and 12 bytes of interframe gap
+	minFrameBits = (64 + 8 + 12) * bitsPerByte
+)
+
+// legacyFPS are the maximum frame rates of the Ethernet types that had
+// fixed constants before the frame rate was derived from the speed.
+// Their rounding differs in the last digit, the constants are kept to
+// not change the derived utilization of these links.
+var legacyFPS = map[int64]int64{
+	10:     14880,
+	100:    148809,
+	1000:   1488096,
+	10000:  14880952,
+	100000: 148809524,
+}
+
+// linkLimits returns the maximum bit rate and the maximum frame rate
+// per second of an Ethernet link with speed in Mbit/s. It returns
+// false for speeds that are unknown.
+func linkLimits(speed int64) (int64, int64, bool) {
+	if speed <= 0 {
+		return 0, 0, false
+	}
+	bps := speed * bitsPerMbit
+	if fps, ok := legacyFPS[speed]; ok {
+		return bps, fps, true
+	}
+	return bps, bps / minFrameBits, true
+}
+
+// speedOverride sets the speed in Mbit/s of the interfaces whose
+// name matches pattern
+type speedOverride struct {
+	pattern string
+	speed   int64
+}
+
+// overrides is a list of speed overrides, ordered from the most to the
+// least specific pattern
+type overrides []speedOverride
+
+// speedOverrides returns the speed overrides configured in settings.
+// Each option speed.override.<pattern> sets the speed of the
+// interfaces matching the shell pattern to the option value. A speed
+// of 0 disables the utilization metrics of the interfaces.
+func speedOverrides(settings config.Deriver) (overrides, error) {
+	o := overrides{}
+	for option, value := range settings.Options {
+		if !strings.HasPrefix(option, optionSpeed) {
+			continue
+		}
+		pattern := strings.TrimPrefix(option, optionSpeed)
+		if _, err := path.Match(pattern, ``); err != nil || pattern == `` {
+			return nil, fmt.Errorf(
+				"netif: invalid interface pattern in option %s", option)
+		}
+		speed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || speed < 0 {
+			return nil, fmt.Errorf(
+				"netif: invalid speed in option %s: %s", option, value)
+		}
+		o = append(o, speedOverride{pattern: pattern, speed: speed})
+	}
+
+	// patterns with more literal characters are more specific
+	sort.Slice(o, func(i, j int) bool {
+		li, lj := literals(o[i].pattern), literals(o[j].pattern)
+		if li != lj {
+			return li > lj
+		}
+		return o[i].pattern < o[j].pattern
+	})
+	return o, nil
+}
+
+// literals returns the number of characters in pattern that are not
+// wildcards
+func literals(pattern string) int {
+	return len(pattern) - strings.Count(pattern, `*`) -
+		strings.Count(pattern, `?`)
+}
+
+// match returns the speed of the first override whose pattern matches
+// the interface name dev
+func (o overrides) match(dev string) (int64, bool) {
+	for i := range o {
+		if ok, _ := path.Match(o[i].pattern, dev); ok {
+			return o[i].speed, true
+		}
+	}
+	return 0, false
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
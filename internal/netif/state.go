@@ -0,0 +1,174 @@
+/*-
+ * Copyright © 2018, 1&1 Internet SE
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package netif // import "github.com/solnx/hurricane/internal/netif"
+
+import (
+	"time"
+
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/reorder"
+)
+
+// state is the serializable form of netIf. Derived values that are
+// recalculated every measurement cycle are not part of the state.
+type state struct {
+	AssetID     int64             `json:"asset.id"`
+	Curr        distributionState `json:"curr"`
+	CurrTime    time.Time         `json:"curr.time"`
+	Buffer      []cycleState      `json:"buffer"`
+	Speed       int64             `json:"speed"`
+	Intf        string            `json:"intf"`
+	Utilization float64           `json:"utilization"`
+	Optional    optionalState     `json:"optional"`
+	Ack         []intf.Offset     `json:"ack"`
+}
+
+// optionalState is the serializable form of optional
+type optionalState struct {
+	RxErrors   bool `json:"rx.errors"`
+	TxErrors   bool `json:"tx.errors"`
+	RxDropped  bool `json:"rx.dropped"`
+	TxDropped  bool `json:"tx.dropped"`
+	Collisions bool `json:"collisions"`
+}
+
+// cycleState is the serializable form of a reorder buffer entry
+type cycleState struct {
+	TS   time.Time         `json:"ts"`
+	Next distributionState `json:"next"`
+}
+
+// distributionState is the serializable form of distribution
+type distributionState struct {
+	SetRxBytes    bool  `json:"set.rx.bytes"`
+	SetRxPackets  bool  `json:"set.rx.packets"`
+	SetTxBytes    bool  `json:"set.tx.bytes"`
+	SetTxPackets  bool  `json:"set.tx.packets"`
+	RxBytes       int64 `json:"rx.bytes"`
+	RxPackets     int64 `json:"rx.packets"`
+	TxBytes       int64 `json:"tx.bytes"`
+	TxPackets     int64 `json:"tx.packets"`
+	SetRxErrors   bool  `json:"set.rx.errors"`
+	SetTxErrors   bool  `json:"set.tx.errors"`
+	SetRxDropped  bool  `json:"set.rx.dropped"`
+	SetTxDropped  bool  `json:"set.tx.dropped"`
+	SetCollisions bool  `json:"set.collisions"`
+	RxErrors      int64 `json:"rx.errors"`
+	TxErrors      int64 `json:"tx.errors"`
+	RxDropped     int64 `json:"rx.dropped"`
+	TxDropped     int64 `json:"tx.dropped"`
+	Collisions    int64 `json:"collisions"`
+}
+
+// export returns the serializable state of n. Outstanding
+// acknowledgements are exported as offsets.
+func (n *netIf) export() state {
+	s := state{
+		AssetID:     n.assetID,
+		Curr:        n.curr.export(),
+		CurrTime:    n.currTime,
+		Buffer:      []cycleState{},
+		Speed:       n.speed,
+		Intf:        n.intf,
+		Utilization: n.utilization,
+		Optional: optionalState{
+			RxErrors:   n.optional.rxErrors,
+			TxErrors:   n.optional.txErrors,
+			RxDropped:  n.optional.rxDropped,
+			TxDropped:  n.optional.txDropped,
+			Collisions: n.optional.collisions,
+		},
+		Ack: append(intf.Offsets(n.outstanding()), n.pending...),
+	}
+	for _, e := range n.buffer.Entries() {
+		s.Buffer = append(s.Buffer, cycleState{
+			TS:   e.TS,
+			Next: e.Value.(*distribution).export(),
+		})
+	}
+	return s
+}
+
+// load sets n to the state s. The acknowledgements in s are stored
+// as pending until their messages are redelivered.
+func (n *netIf) load(s state) {
+	n.assetID = s.AssetID
+	n.curr = s.Curr.load()
+	n.currTime = s.CurrTime
+	for i := range s.Buffer {
+		next := s.Buffer[i].Next.load()
+		n.buffer.Insert(&reorder.Entry{
+			TS:    s.Buffer[i].TS,
+			Start: time.Now(),
+			Value: &next,
+		})
+	}
+	n.speed = s.Speed
+	n.intf = s.Intf
+	n.utilization = s.Utilization
+	n.optional = optional{
+		rxErrors:   s.Optional.RxErrors,
+		txErrors:   s.Optional.TxErrors,
+		rxDropped:  s.Optional.RxDropped,
+		txDropped:  s.Optional.TxDropped,
+		collisions: s.Optional.Collisions,
+	}
+	n.pending = s.Ack
+	n.lastSeen = time.Now()
+}
+
+// export returns the serializable state of d
+func (d *distribution) export() distributionState {
+	return distributionState{
+		SetRxBytes:    d.setRxBytes,
+		SetRxPackets:  d.setRxPackets,
+		SetTxBytes:    d.setTxBytes,
+		SetTxPackets:  d.setTxPackets,
+		RxBytes:       d.rxBytes,
+		RxPackets:     d.rxPackets,
+		TxBytes:       d.txBytes,
+		TxPackets:     d.txPackets,
+		SetRxErrors:   d.setRxErrors,
+		SetTxErrors:   d.setTxErrors,
+		SetRxDropped:  d.setRxDropped,
+		SetTxDropped:  d.setTxDropped,
+		SetCollisions: d.setCollisions,
+		RxErrors:      d.rxErrors,
+		TxErrors:      d.txErrors,
+		RxDropped:     d.rxDropped,
+		TxDropped:     d.txDropped,
+		Collisions:    d.collisions,
+	}
+}
+
+// load returns the distribution described by s
+func (s distributionState) load() distribution {
+	return distribution{
+		setRxBytes:    s.SetRxBytes,
+		setRxPackets:  s.SetRxPackets,
+		setTxBytes:    s.SetTxBytes,
+		setTxPackets:  s.SetTxPackets,
+		rxBytes:       s.RxBytes,
+		rxPackets:     s.RxPackets,
+		txBytes:       s.TxBytes,
+		txPackets:     s.TxPackets,
+		setRxErrors:   s.SetRxErrors,
+		setTxErrors:   s.SetTxErrors,
+		setRxDropped:  s.SetRxDropped,
+		setTxDropped:  s.SetTxDropped,
+		setCollisions: s.SetCollisions,
+		rxErrors:      s.RxErrors,
+		txErrors:      s.TxErrors,
+		rxDropped:     s.RxDropped,
+		txDropped:     s.TxDropped,
+		collisions:    s.Collisions,
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
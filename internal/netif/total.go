@@ -0,0 +1,104 @@
+/*-
+ * Copyright © 2018, 1&1 Internet SE
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package netif // import "github.com/solnx/hurricane/internal/netif"
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/solnx/hurricane/internal/config"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/rollup"
+	"github.com/solnx/legacy"
+)
+
+// option to exclude interfaces from the per asset totals
+const optionExclude = `rollup.exclude`
+
+// reportFunc is called by a netIf with the byte rates of a measurement
+// cycle and returns the derived per asset totals once the cycle is
+// complete for all interfaces of the asset
+type reportFunc func(ts time.Time, values ...float64) ([]*legacy.MetricSplit, error)
+
+// rollupExclude returns the interface patterns configured in settings
+// that are excluded from the per asset totals
+func rollupExclude(settings config.Deriver) (rollup.Exclude, error) {
+	e, err := rollup.ParseExclude(settings.Options[optionExclude])
+	if err != nil {
+		return nil, fmt.Errorf("netif: invalid option %s: %s",
+			optionExclude, err.Error())
+	}
+	return e, nil
+}
+
+// excluded checks if the interface dev is not part of the per asset
+// totals
+func (d *Deriver) excluded(dev string) bool {
+	return dev == `lo` || d.exclude.Match(dev)
+}
+
+// reporter returns the reportFunc of the interface dev of assetID. It
+// returns nil for excluded interfaces.
+func (d *Deriver) reporter(assetID int64, dev string) reportFunc {
+	if d.excluded(dev) {
+		return nil
+	}
+	return func(ts time.Time, values ...float64) ([]*legacy.MetricSplit, error) {
+		return d.total(assetID, dev, ts, values)
+	}
+}
+
+// total adds the byte rates of interface dev of assetID for the
+// measurement cycle ts and returns the per asset totals if all
+// interfaces with a known speed have reported the cycle
+func (d *Deriver) total(assetID int64, dev string, ts time.Time, values []float64) ([]*legacy.MetricSplit, error) {
+	if _, ok := d.totals[assetID]; !ok {
+		d.totals[assetID] = rollup.New()
+	}
+	members := []string{}
+	for name, n := range d.data[assetID] {
+		if !d.excluded(name) && n.speedKnown() {
+			members = append(members, name)
+		}
+	}
+
+	sums, ok := d.totals[assetID].Add(ts, dev, values, members)
+	if !ok {
+		return nil, nil
+	}
+	result := []*legacy.MetricSplit{
+		{
+			AssetID: assetID,
+			Path:    `net.rx.bytes.per.second`,
+			TS:      ts,
+			Type:    `real`,
+			Unit:    `Bps`,
+			Val: legacy.MetricValue{
+				FlpVal: round(sums[0], .5, 2),
+			},
+		},
+		{
+			AssetID: assetID,
+			Path:    `net.tx.bytes.per.second`,
+			TS:      ts,
+			Type:    `real`,
+			Unit:    `Bps`,
+			Val: legacy.MetricValue{
+				FlpVal: round(sums[1], .5, 2),
+			},
+		},
+	}
+	if err := intf.LookupTags(d.lookup, result); err != nil {
+		// do not emit potentially incorrect metrics
+		return nil, err
+	}
+	return result, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
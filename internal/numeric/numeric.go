@@ -0,0 +1,113 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+// Package numeric converts the values of input metrics to numbers.
+// Integer, real and string values are accepted as long as they hold
+// a finite number, everything else is rejected with an *Error that
+// carries the reason for the rejection.
+package numeric // import "github.com/solnx/hurricane/internal/numeric"
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/solnx/legacy"
+)
+
+// Reasons for rejecting a value
+const (
+	// the value type is not numeric
+	ReasonType = `type`
+	// the string value does not hold a number
+	ReasonParse = `parse`
+	// the value is not a number
+	ReasonNaN = `nan`
+	// the value is infinite
+	ReasonInf = `inf`
+	// the value does not fit into an int64
+	ReasonRange = `range`
+)
+
+// Error is returned for metrics whose value can not be used as number
+type Error struct {
+	Path   string
+	Type   string
+	Reason string
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	return fmt.Sprintf("numeric: rejected %s value of %s: %s",
+		e.Type, e.Path, e.Reason)
+}
+
+// Float64 returns the value of m as float64
+func Float64(m *legacy.MetricSplit) (float64, error) {
+	var f float64
+	switch v := m.Value().(type) {
+	case int64:
+		return float64(v), nil
+	case float64:
+		f = v
+	case string:
+		var err error
+		if f, err = strconv.ParseFloat(strings.TrimSpace(v), 64); err != nil {
+			if ne, ok := err.(*strconv.NumError); !ok || ne.Err != strconv.ErrRange {
+				return 0, reject(m, ReasonParse)
+			}
+		}
+	default:
+		return 0, reject(m, ReasonType)
+	}
+
+	switch {
+	case math.IsNaN(f):
+		return 0, reject(m, ReasonNaN)
+	case math.IsInf(f, 0):
+		return 0, reject(m, ReasonInf)
+	}
+	return f, nil
+}
+
+// Int64 returns the value of m as int64. Real values are truncated
+// towards zero.
+func Int64(m *legacy.MetricSplit) (int64, error) {
+	switch v := m.Value().(type) {
+	case int64:
+		return v, nil
+	case string:
+		// integer strings are parsed directly to keep the precision
+		// of large counters
+		if i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			return i, nil
+		}
+	}
+
+	f, err := Float64(m)
+	if err != nil {
+		return 0, err
+	}
+	// float64(math.MaxInt64) rounds up to 2^63
+	if f >= math.MaxInt64 || f < math.MinInt64 {
+		return 0, reject(m, ReasonRange)
+	}
+	return int64(f), nil
+}
+
+// reject returns the error for rejecting the value of m for reason
+func reject(m *legacy.MetricSplit, reason string) error {
+	return &Error{
+		Path:   m.Path,
+		Type:   m.Type,
+		Reason: reason,
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
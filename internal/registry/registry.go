@@ -0,0 +1,90 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+// Package registry provides the named registry of deriver factories.
+// Deriver packages register their factory from init(), a deriver is
+// compiled into hurricane by importing its package.
+package registry // import "github.com/solnx/hurricane/internal/registry"
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/hurricane/internal/config"
+	"github.com/solnx/hurricane/internal/intf"
+)
+
+// Factory returns a new instance of a deriver. The deriver specific
+// settings are available via settings.Deriver(), lookup is used to
+// look up the tags of derived metrics.
+type Factory func(conf *erebos.Config, settings *config.Config, lookup intf.TagLookup) (intf.Deriver, error)
+
+var (
+	mutex     sync.RWMutex
+	factories = make(map[string]Factory)
+)
+
+// Register makes the deriver factory f available under name. It
+// panics if name is already registered or f is nil.
+func Register(name string, f Factory) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if f == nil {
+		panic(`registry: Register factory is nil`)
+	}
+	if _, ok := factories[name]; ok {
+		panic(`registry: Register called twice for deriver ` + name)
+	}
+	factories[name] = f
+}
+
+// New returns a new instance of the deriver registered as name
+func New(name string, conf *erebos.Config, settings *config.Config, lookup intf.TagLookup) (intf.Deriver, error) {
+	mutex.RLock()
+	f, ok := factories[name]
+	mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("registry: unknown deriver %s", name)
+	}
+	return f(conf, settings, lookup)
+}
+
+// Names returns the sorted names of all registered derivers
+func Names() []string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check returns an error if one of names is not a registered deriver
+func Check(names []string) error {
+	for _, name := range names {
+		mutex.RLock()
+		_, ok := factories[name]
+		mutex.RUnlock()
+
+		if !ok {
+			return fmt.Errorf("registry: unknown deriver %s, available derivers: %s",
+				name, strings.Join(Names(), `, `))
+		}
+	}
+	return nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,32 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package registry // import "github.com/solnx/hurricane/internal/registry"
+
+import (
+	"testing"
+
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/hurricane/internal/config"
+	"github.com/solnx/hurricane/internal/intf"
+)
+
+func TestCheck(t *testing.T) {
+	Register(`check`, func(*erebos.Config, *config.Config, intf.TagLookup) (intf.Deriver, error) {
+		return nil, nil
+	})
+
+	if err := Check([]string{`check`}); err != nil {
+		t.Errorf("registered deriver was rejected: %s", err)
+	}
+	if err := Check([]string{`check`, `cpu2`}); err == nil {
+		t.Errorf("unknown deriver was accepted")
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
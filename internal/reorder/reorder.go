@@ -0,0 +1,145 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+// Package reorder provides a bounded buffer that allows derivers to
+// assemble the distributions of multiple measurement cycles at once
+package reorder // import "github.com/solnx/hurricane/internal/reorder"
+
+import (
+	"sort"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+)
+
+// Buffer holds the measurement cycles of one asset that are still
+// being assembled, ordered by their timestamp
+type Buffer struct {
+	window  time.Duration
+	cycles  int
+	entries []*Entry
+}
+
+// Entry is a single measurement cycle within a Buffer
+type Entry struct {
+	// timestamp of the measurement cycle
+	TS time.Time
+	// time the first metric of the cycle was received
+	Start time.Time
+	// transports that contributed to the cycle
+	Acks []*erebos.Transport
+	// the deriver specific distribution
+	Value interface{}
+}
+
+// New returns a Buffer that holds measurement cycles spanning at most
+// window, but no more than cycles entries. A zero value disables the
+// respective limit. If both are zero, the Buffer holds a single cycle.
+func New(window time.Duration, cycles int) *Buffer {
+	if window <= 0 && cycles <= 0 {
+		cycles = 1
+	}
+	return &Buffer{
+		window:  window,
+		cycles:  cycles,
+		entries: []*Entry{},
+	}
+}
+
+// Get returns the Entry for timestamp ts. If there is no such Entry,
+// a new one is inserted with the value returned by value.
+func (b *Buffer) Get(ts time.Time, value func() interface{}) *Entry {
+	if i := b.search(ts); i < len(b.entries) && b.entries[i].TS.Equal(ts) {
+		return b.entries[i]
+	}
+
+	e := &Entry{
+		TS:    ts,
+		Start: time.Now(),
+		Acks:  []*erebos.Transport{},
+		Value: value(),
+	}
+	b.Insert(e)
+	return e
+}
+
+// Insert adds e to b, replacing an existing Entry for the same
+// timestamp. It is used to restore a Buffer.
+func (b *Buffer) Insert(e *Entry) {
+	i := b.search(e.TS)
+	if i < len(b.entries) && b.entries[i].TS.Equal(e.TS) {
+		b.entries[i] = e
+		return
+	}
+	b.entries = append(b.entries, nil)
+	copy(b.entries[i+1:], b.entries[i:])
+	b.entries[i] = e
+}
+
+// search returns the index of the first Entry in b that is not older
+// than ts
+func (b *Buffer) search(ts time.Time) int {
+	return sort.Search(len(b.entries), func(i int) bool {
+		return !b.entries[i].TS.Before(ts)
+	})
+}
+
+// Trim removes the oldest entries that no longer fit into the
+// configured window and returns their transports
+func (b *Buffer) Trim() []*erebos.Transport {
+	acks := []*erebos.Transport{}
+	for len(b.entries) > 0 {
+		newest := b.entries[len(b.entries)-1].TS
+		if b.cycles > 0 && len(b.entries) > b.cycles {
+			acks = append(acks, b.Pop().Acks...)
+			continue
+		}
+		if b.window > 0 && newest.Sub(b.entries[0].TS) > b.window {
+			acks = append(acks, b.Pop().Acks...)
+			continue
+		}
+		break
+	}
+	return acks
+}
+
+// Oldest returns the Entry with the oldest timestamp, or nil if b is
+// empty
+func (b *Buffer) Oldest() *Entry {
+	if len(b.entries) == 0 {
+		return nil
+	}
+	return b.entries[0]
+}
+
+// Pop removes the Entry with the oldest timestamp from b and returns
+// it. It returns nil if b is empty.
+func (b *Buffer) Pop() *Entry {
+	if len(b.entries) == 0 {
+		return nil
+	}
+	e := b.entries[0]
+	b.entries = b.entries[1:]
+	return e
+}
+
+// Entries returns all entries of b ordered by timestamp
+func (b *Buffer) Entries() []*Entry {
+	return b.entries
+}
+
+// Acks returns the transports of all entries in b
+func (b *Buffer) Acks() []*erebos.Transport {
+	acks := []*erebos.Transport{}
+	for i := range b.entries {
+		acks = append(acks, b.entries[i].Acks...)
+	}
+	return acks
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,124 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+// Package rollup provides the accounting for derived metrics of an
+// asset that are aggregated over its members, like the interfaces or
+// mountpoints of a host. The members report their values per
+// measurement cycle and a cycle is complete once all known members
+// have reported.
+package rollup // import "github.com/solnx/hurricane/internal/rollup"
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxCycles is the number of incomplete measurement cycles that are
+// held per asset
+const maxCycles = 16
+
+// Rollup sums the values the members of one asset report per
+// measurement cycle
+type Rollup struct {
+	cycles    map[time.Time]map[string][]float64
+	completed time.Time
+}
+
+// New returns an empty Rollup
+func New() *Rollup {
+	return &Rollup{
+		cycles: make(map[time.Time]map[string][]float64),
+	}
+}
+
+// Add records the values member reported for the measurement cycle
+// at ts. members are the names of all known members of the asset. If
+// all of them have reported for the cycle, Add returns the sums of
+// their values and discards the cycle and all older cycles. Values
+// for cycles that are not newer than the last complete cycle are
+// ignored.
+func (r *Rollup) Add(ts time.Time, member string, values []float64, members []string) ([]float64, bool) {
+	if !ts.After(r.completed) {
+		return nil, false
+	}
+	if _, ok := r.cycles[ts]; !ok {
+		r.cycles[ts] = make(map[string][]float64)
+		r.trim()
+	}
+	r.cycles[ts][member] = values
+
+	sums := make([]float64, len(values))
+	for _, name := range members {
+		reported, ok := r.cycles[ts][name]
+		if !ok || len(reported) != len(sums) {
+			return nil, false
+		}
+		for i := range reported {
+			sums[i] += reported[i]
+		}
+	}
+
+	r.completed = ts
+	for cycle := range r.cycles {
+		if !cycle.After(ts) {
+			delete(r.cycles, cycle)
+		}
+	}
+	return sums, true
+}
+
+// trim discards the oldest incomplete cycles beyond maxCycles
+func (r *Rollup) trim() {
+	if len(r.cycles) <= maxCycles {
+		return
+	}
+	cycles := make([]time.Time, 0, len(r.cycles))
+	for cycle := range r.cycles {
+		cycles = append(cycles, cycle)
+	}
+	sort.Slice(cycles, func(i, j int) bool {
+		return cycles[i].Before(cycles[j])
+	})
+	for _, cycle := range cycles[:len(cycles)-maxCycles] {
+		delete(r.cycles, cycle)
+	}
+}
+
+// Exclude is a list of shell patterns for member names that are not
+// part of a rollup
+type Exclude []string
+
+// ParseExclude returns the patterns of the comma separated list s
+func ParseExclude(s string) (Exclude, error) {
+	e := Exclude{}
+	for _, pattern := range strings.Split(s, `,`) {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == `` {
+			continue
+		}
+		if _, err := path.Match(pattern, ``); err != nil {
+			return nil, err
+		}
+		e = append(e, pattern)
+	}
+	return e, nil
+}
+
+// Match checks if name matches one of the patterns in e
+func (e Exclude) Match(name string) bool {
+	for _, pattern := range e {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,263 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package rule // import "github.com/solnx/hurricane/internal/rule"
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/hurricane/internal/config"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/numeric"
+	"github.com/solnx/hurricane/internal/registry"
+	"github.com/solnx/hurricane/internal/reorder"
+	"github.com/solnx/legacy"
+)
+
+// Implementation of the intf.Deriver interface
+
+func init() {
+	registry.Register(`rule`, func(conf *erebos.Config, settings *config.Config, lookup intf.TagLookup) (intf.Deriver, error) {
+		if settings == nil {
+			return nil, fmt.Errorf("rule: missing settings")
+		}
+		d, err := NewDeriver(lookup, settings.Deriver(`rule`),
+			settings.Hurricane.Rules)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	})
+}
+
+// NewDeriver returns a Deriver for rules. It returns an error if a
+// rule is invalid.
+func NewDeriver(lookup intf.TagLookup, settings config.Deriver, rules []config.Rule) (*Deriver, error) {
+	d := &Deriver{}
+	d.paths = make(map[string][]*Rule)
+	d.data = make(map[string]map[int64]map[string]*unit)
+	d.refs = make(map[*erebos.Transport]int)
+	for i := range rules {
+		r, err := compile(rules[i])
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := d.data[r.name]; ok {
+			return nil, fmt.Errorf("rule %s: duplicate rule name", r.name)
+		}
+		d.data[r.name] = make(map[int64]map[string]*unit)
+		for _, path := range r.inputs {
+			d.paths[path] = append(d.paths[path], r)
+		}
+		d.rules = append(d.rules, r)
+	}
+	d.lookup = lookup
+	d.window = time.Duration(settings.ReorderWindow) * time.Second
+	d.cycles = settings.ReorderCycles
+	return d, nil
+}
+
+// Deriver ...
+type Deriver struct {
+	rules  []*Rule
+	paths  map[string][]*Rule
+	data   map[string]map[int64]map[string]*unit
+	refs   map[*erebos.Transport]int
+	lookup intf.TagLookup
+	window time.Duration
+	cycles int
+}
+
+// Start ...
+func (d *Deriver) Start() error {
+	return d.lookup.Start()
+}
+
+// Close ...
+func (d *Deriver) Close() {
+	d.lookup.Close()
+}
+
+// Register ...
+func (d *Deriver) Register(m map[string]intf.Deriver) {
+	for path := range d.paths {
+		m[path] = d
+	}
+}
+
+// Update ...
+func (d *Deriver) Update(m *legacy.MetricSplit, t *erebos.Transport) ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	v, err := numeric.Float64(m)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	units := []*unit{}
+	for _, r := range d.paths[m.Path] {
+		group, grouped := r.grouping(m)
+		if !grouped {
+			continue
+		}
+		units = append(units, d.unit(r, m.AssetID, group))
+	}
+	if len(units) == 0 {
+		return []*legacy.MetricSplit{}, []*erebos.Transport{t}, true, nil
+	}
+
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var ok bool
+	for _, u := range units {
+		res, a, done, err := u.update(m, t, v)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if done {
+			derived = append(derived, res...)
+			acks = append(acks, a...)
+			ok = true
+		}
+	}
+
+	// t is acknowledged once all units have released it. The count is
+	// only set after all units accepted t, releasing earlier could
+	// acknowledge t while it is still held.
+	d.refs[t] = len(units)
+	return derived, d.release(acks), ok, nil
+}
+
+// unit returns the unit of rule r for group of assetID
+func (d *Deriver) unit(r *Rule, assetID int64, group string) *unit {
+	if _, ok := d.data[r.name][assetID]; !ok {
+		d.data[r.name][assetID] = make(map[string]*unit)
+	}
+	if _, ok := d.data[r.name][assetID][group]; !ok {
+		d.data[r.name][assetID][group] = &unit{
+			rule:    r,
+			assetID: assetID,
+			group:   group,
+			lookup:  d.lookup,
+			buffer:  reorder.New(d.window, d.cycles),
+		}
+	}
+	return d.data[r.name][assetID][group]
+}
+
+// release returns the transports of acks that are no longer held by
+// any unit
+func (d *Deriver) release(acks []*erebos.Transport) []*erebos.Transport {
+	released := []*erebos.Transport{}
+	for _, t := range acks {
+		if _, ok := d.refs[t]; ok {
+			d.refs[t]--
+			if d.refs[t] > 0 {
+				continue
+			}
+			delete(d.refs, t)
+		}
+		released = append(released, t)
+	}
+	return released
+}
+
+// Snapshot ...
+func (d *Deriver) Snapshot() ([]byte, error) {
+	s := make(map[string]map[int64]map[string]state, len(d.data))
+	for name := range d.data {
+		s[name] = make(map[int64]map[string]state, len(d.data[name]))
+		for assetID := range d.data[name] {
+			s[name][assetID] = make(map[string]state)
+			for group := range d.data[name][assetID] {
+				s[name][assetID][group] = d.data[name][assetID][group].export()
+			}
+		}
+	}
+	return json.Marshal(s)
+}
+
+// Restore ...
+func (d *Deriver) Restore(b []byte) error {
+	s := make(map[string]map[int64]map[string]state)
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	for _, r := range d.rules {
+		// state of rules that are no longer configured is skipped,
+		// their messages are redelivered
+		for assetID := range s[r.name] {
+			for group := range s[r.name][assetID] {
+				d.unit(r, assetID, group).load(s[r.name][assetID][group])
+			}
+		}
+	}
+	return nil
+}
+
+// Evict ...
+func (d *Deriver) Evict(deadline time.Time) ([]*erebos.Transport, int) {
+	acks := []*erebos.Transport{}
+	var evicted int
+	for name := range d.data {
+		for assetID := range d.data[name] {
+			for group := range d.data[name][assetID] {
+				if d.data[name][assetID][group].lastSeen.Before(deadline) {
+					acks = append(acks, d.release(
+						d.data[name][assetID][group].outstanding(),
+					)...)
+					delete(d.data[name][assetID], group)
+					evicted++
+				}
+			}
+			if len(d.data[name][assetID]) == 0 {
+				delete(d.data[name], assetID)
+			}
+		}
+	}
+	return acks, evicted
+}
+
+// Drop ...
+func (d *Deriver) Drop(assetID int64) []*erebos.Transport {
+	acks := []*erebos.Transport{}
+	for name := range d.data {
+		for group := range d.data[name][assetID] {
+			acks = append(acks, d.release(
+				d.data[name][assetID][group].outstanding(),
+			)...)
+		}
+		delete(d.data[name], assetID)
+	}
+	return acks
+}
+
+// Expire ...
+func (d *Deriver) Expire(deadline time.Time, partial bool) ([]*legacy.MetricSplit, []*erebos.Transport, int, int, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var dropped, evaluated int
+	for name := range d.data {
+		for assetID := range d.data[name] {
+			for group := range d.data[name][assetID] {
+				m, a, drp, evl, err := d.data[name][assetID][group].expire(deadline, partial)
+				if err != nil {
+					return nil, nil, 0, 0, err
+				}
+				derived = append(derived, m...)
+				acks = append(acks, d.release(a)...)
+				dropped += drp
+				evaluated += evl
+			}
+		}
+	}
+	return derived, acks, dropped, evaluated, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
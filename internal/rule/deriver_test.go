@@ -0,0 +1,144 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package rule // import "github.com/solnx/hurricane/internal/rule"
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/hurricane/internal/config"
+	"github.com/solnx/hurricane/internal/derivertest"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/lookup"
+	"github.com/solnx/legacy"
+)
+
+// rules covers every operation, a grouped rule and an input that is
+// shared by two rules
+var rules = []config.Rule{
+	{
+		Name:      `rx`,
+		Inputs:    []string{`/sys/net/rx_bytes`},
+		GroupTag:  `0`,
+		Operation: `rate`,
+		Path:      `net.rx.bytes.per.second`,
+		Unit:      `Bps`,
+	},
+	{
+		Name:      `ctx`,
+		Inputs:    []string{`/sys/cpu/ctx`},
+		Operation: `delta`,
+		Path:      `cpu.ctx.switches`,
+		Type:      `integer`,
+	},
+	{
+		Name:      `lru`,
+		Inputs:    []string{`/sys/memory/active`, `/sys/memory/inactive`},
+		Operation: `sum`,
+		Path:      `memory.lru.kilobytes`,
+		Unit:      `kB`,
+		Type:      `integer`,
+	},
+	{
+		Name:      `hits`,
+		Inputs:    []string{`/sys/disk/cache_hits`, `/sys/disk/cache_lookups`},
+		Operation: `ratio`,
+		Path:      `disk.cache.hit.ratio`,
+	},
+	{
+		Name:      `lookups`,
+		Inputs:    []string{`/sys/disk/cache_lookups`},
+		Operation: `rate`,
+		Path:      `disk.cache.lookups.per.second`,
+	},
+	{
+		Name:      `usage`,
+		Inputs:    []string{`/sys/disk/blk_used`, `/sys/disk/blk_total`},
+		GroupTag:  `0`,
+		Operation: `percent-of`,
+		Path:      `disk.usage.percent`,
+		Unit:      `%`,
+	},
+}
+
+func TestGolden(t *testing.T) {
+	derivertest.Suite(t, `testdata`, func(lookup intf.TagLookup) intf.Deriver {
+		d, err := NewDeriver(lookup, config.Deriver{
+			ReorderCycles: 2,
+		}, rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
+
+func TestCompile(t *testing.T) {
+	for _, test := range []struct {
+		rule  config.Rule
+		valid bool
+	}{
+		{config.Rule{Name: `a`, Inputs: []string{`/x`}, Operation: `rate`, Path: `x`}, true},
+		{config.Rule{Name: `a`, Inputs: []string{`/x`, `/y`}, Operation: `percent-of`, Path: `x`, Type: `integer`, GroupTag: `1`}, true},
+		{config.Rule{Inputs: []string{`/x`}, Operation: `sum`, Path: `x`}, false},
+		{config.Rule{Name: `a`, Inputs: []string{`/x`}, Operation: `sum`}, false},
+		{config.Rule{Name: `a`, Operation: `sum`, Path: `x`}, false},
+		{config.Rule{Name: `a`, Inputs: []string{`/x`, `/x`}, Operation: `sum`, Path: `x`}, false},
+		{config.Rule{Name: `a`, Inputs: []string{`/x`}, Operation: `ratio`, Path: `x`}, false},
+		{config.Rule{Name: `a`, Inputs: []string{`/x`, `/y`, `/z`}, Operation: `percent-of`, Path: `x`}, false},
+		{config.Rule{Name: `a`, Inputs: []string{`/x`}, Operation: `avg`, Path: `x`}, false},
+		{config.Rule{Name: `a`, Inputs: []string{`/x`}, Operation: `sum`, Path: `x`, Type: `string`}, false},
+		{config.Rule{Name: `a`, Inputs: []string{`/x`}, Operation: `sum`, Path: `x`, GroupTag: `mpt`}, false},
+		{config.Rule{Name: `a`, Inputs: []string{`/x`}, Operation: `sum`, Path: `x`, GroupTag: `-1`}, false},
+	} {
+		if _, err := compile(test.rule); (err == nil) != test.valid {
+			t.Errorf("rule %+v: valid %t, got error %v",
+				test.rule, test.valid, err)
+		}
+	}
+
+	if _, err := NewDeriver(lookup.NewMemory(), config.Deriver{},
+		[]config.Rule{rules[0], rules[0]}); err == nil {
+		t.Errorf("duplicate rule name was accepted")
+	}
+}
+
+// TestUpdateError checks that a transport is not held after a failed
+// update of one of the units it was passed to
+func TestUpdateError(t *testing.T) {
+	l := lookup.NewMemory()
+	d, err := NewDeriver(l, config.Deriver{}, []config.Rule{
+		{Name: `a`, Inputs: []string{`/x`}, Operation: `sum`, Path: `a`},
+		{Name: `b`, Inputs: []string{`/x`}, Operation: `sum`, Path: `b`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Fail((&legacy.MetricSplit{AssetID: 1, Path: `b`}).LookupID(),
+		fmt.Errorf("lookup failed"))
+
+	m := &legacy.MetricSplit{
+		AssetID: 1,
+		Path:    `/x`,
+		TS:      time.Date(2017, 6, 1, 10, 0, 0, 0, time.UTC),
+		Type:    `integer`,
+		Val:     legacy.MetricValue{IntVal: 1},
+	}
+	if _, _, _, err := d.Update(m, &erebos.Transport{}); err == nil {
+		t.Fatal("failed lookup did not fail the update")
+	}
+	if len(d.refs) != 0 {
+		t.Errorf("%d transports held after failed update, expected 0",
+			len(d.refs))
+	}
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,218 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+// Package rule provides derived metrics that are declared as rules in
+// the hurricane configuration. Supported operations are:
+//	- rate: per second change of the sum of the inputs
+//	- delta: change of the sum of the inputs
+//	- ratio: first input divided by the second input
+//	- sum: sum of the inputs
+//	- percent-of: first input in percent of the second input
+package rule // import "github.com/solnx/hurricane/internal/rule"
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/solnx/hurricane/internal/config"
+	"github.com/solnx/legacy"
+)
+
+// Operations supported by a Rule
+const (
+	opRate      = `rate`
+	opDelta     = `delta`
+	opRatio     = `ratio`
+	opSum       = `sum`
+	opPercentOf = `percent-of`
+)
+
+// Rule is the validated form of a config.Rule
+type Rule struct {
+	name      string
+	inputs    []string
+	group     int
+	operation string
+	path      string
+	unit      string
+	valueType string
+}
+
+// compile validates r and returns the corresponding Rule
+func compile(r config.Rule) (*Rule, error) {
+	rule := &Rule{
+		name:      r.Name,
+		inputs:    r.Inputs,
+		group:     -1,
+		operation: r.Operation,
+		path:      r.Path,
+		unit:      r.Unit,
+		valueType: r.Type,
+	}
+
+	if rule.name == `` {
+		return nil, fmt.Errorf("rule: missing rule name")
+	}
+	if rule.path == `` {
+		return nil, fmt.Errorf("rule %s: missing output path", rule.name)
+	}
+	if len(rule.inputs) == 0 {
+		return nil, fmt.Errorf("rule %s: missing inputs", rule.name)
+	}
+	seen := make(map[string]struct{}, len(rule.inputs))
+	for _, path := range rule.inputs {
+		if _, ok := seen[path]; ok {
+			return nil, fmt.Errorf("rule %s: duplicate input %s",
+				rule.name, path)
+		}
+		seen[path] = struct{}{}
+	}
+
+	switch rule.operation {
+	case opRate, opDelta, opSum:
+	case opRatio, opPercentOf:
+		if len(rule.inputs) != 2 {
+			return nil, fmt.Errorf(
+				"rule %s: operation %s requires exactly two inputs",
+				rule.name, rule.operation)
+		}
+	default:
+		return nil, fmt.Errorf("rule %s: unknown operation '%s'",
+			rule.name, rule.operation)
+	}
+
+	switch rule.valueType {
+	case ``:
+		rule.valueType = `real`
+	case `real`, `integer`:
+	default:
+		return nil, fmt.Errorf("rule %s: unknown output type '%s'",
+			rule.name, rule.valueType)
+	}
+
+	if rule.unit == `` {
+		rule.unit = `#`
+	}
+
+	if r.GroupTag != `` {
+		idx, err := strconv.Atoi(r.GroupTag)
+		if err != nil || idx < 0 {
+			return nil, fmt.Errorf("rule %s: invalid group tag '%s'",
+				rule.name, r.GroupTag)
+		}
+		rule.group = idx
+	}
+	return rule, nil
+}
+
+// grouping returns the group of m. It returns false if m does not
+// carry the grouping tag.
+func (r *Rule) grouping(m *legacy.MetricSplit) (string, bool) {
+	if r.group < 0 {
+		return ``, true
+	}
+	if len(m.Tags) <= r.group {
+		return ``, false
+	}
+	return m.Tags[r.group], true
+}
+
+// stateful reports whether the operation of r requires the inputs of
+// the previous measurement cycle
+func (r *Rule) stateful() bool {
+	return r.operation == opRate || r.operation == opDelta
+}
+
+// apply calculates the result of r for the measurement cycle next at
+// time nextTime, with prev being the previous measurement cycle at
+// time prevTime. It returns false if there is no valid result.
+func (r *Rule) apply(prev cycle, prevTime time.Time, next cycle, nextTime time.Time) (float64, bool) {
+	switch r.operation {
+	case opSum:
+		return next.sum(), true
+	case opRatio, opPercentOf:
+		if next[r.inputs[1]] == 0 {
+			return 0, false
+		}
+		res := next[r.inputs[0]] / next[r.inputs[1]]
+		if r.operation == opPercentOf {
+			res = res * 100
+		}
+		return round(res, .5, 4), true
+	case opDelta:
+		return next.sum() - prev.sum(), true
+	case opRate:
+		delta := nextTime.Sub(prevTime).Seconds()
+		diff := next.sum() - prev.sum()
+		// counter reset
+		if diff < 0 || delta <= 0 {
+			return 0, false
+		}
+		return round(diff/delta, .5, 2), true
+	}
+	return 0, false
+}
+
+// output returns the output path of r for group
+func (r *Rule) output(group string) string {
+	if r.group < 0 {
+		return r.path
+	}
+	return fmt.Sprintf("%s:%s", r.path, group)
+}
+
+// cycle holds the input values of a rule from the same measurement
+// cycle, indexed by metric path
+type cycle map[string]float64
+
+// valid checks if c contains all inputs of r
+func (c cycle) valid(r *Rule) bool {
+	for _, path := range r.inputs {
+		if _, ok := c[path]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// fill copies the values that are missing in c from prev
+func (c cycle) fill(prev cycle) {
+	for path := range prev {
+		if _, ok := c[path]; !ok {
+			c[path] = prev[path]
+		}
+	}
+}
+
+// sum returns the sum of all values in c
+func (c cycle) sum() float64 {
+	var s float64
+	for path := range c {
+		s += c[path]
+	}
+	return s
+}
+
+// https://gist.github.com/DavidVaini/10308388
+func round(val float64, roundOn float64, places int) (newVal float64) {
+	var round float64
+	pow := math.Pow(10, float64(places))
+	digit := pow * val
+	_, div := math.Modf(digit)
+	if div >= roundOn {
+		round = math.Ceil(digit)
+	} else {
+		round = math.Floor(digit)
+	}
+	newVal = round / pow
+	return
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,70 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package rule // import "github.com/solnx/hurricane/internal/rule"
+
+import (
+	"time"
+
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/reorder"
+)
+
+// state is the serializable form of unit
+type state struct {
+	Curr     cycle         `json:"curr"`
+	CurrTime time.Time     `json:"curr.time"`
+	Buffer   []cycleState  `json:"buffer"`
+	Ack      []intf.Offset `json:"ack"`
+}
+
+// cycleState is the serializable form of a reorder buffer entry
+type cycleState struct {
+	TS   time.Time `json:"ts"`
+	Next cycle     `json:"next"`
+}
+
+// export returns the serializable state of u. Outstanding
+// acknowledgements are exported as offsets.
+func (u *unit) export() state {
+	s := state{
+		Curr:     u.curr,
+		CurrTime: u.currTime,
+		Buffer:   []cycleState{},
+		Ack:      append(intf.Offsets(u.outstanding()), u.pending...),
+	}
+	for _, e := range u.buffer.Entries() {
+		s.Buffer = append(s.Buffer, cycleState{
+			TS:   e.TS,
+			Next: e.Value.(cycle),
+		})
+	}
+	return s
+}
+
+// load sets u to the state s. The acknowledgements in s are stored
+// as pending until their messages are redelivered.
+func (u *unit) load(s state) {
+	u.curr = s.Curr
+	u.currTime = s.CurrTime
+	for i := range s.Buffer {
+		next := s.Buffer[i].Next
+		if next == nil {
+			next = cycle{}
+		}
+		u.buffer.Insert(&reorder.Entry{
+			TS:    s.Buffer[i].TS,
+			Start: time.Now(),
+			Value: next,
+		})
+	}
+	u.pending = s.Ack
+	u.lastSeen = time.Now()
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix
@@ -0,0 +1,202 @@
+/*-
+ * Copyright © 2017, Jörg Pernfuß <code.jpe@gmail.com>
+ * All rights reserved.
+ *
+ * Use of this source code is governed by a 2-clause BSD license
+ * that can be found in the LICENSE file.
+ */
+
+package rule // import "github.com/solnx/hurricane/internal/rule"
+
+import (
+	"math"
+	"time"
+
+	"github.com/mjolnir42/erebos"
+	"github.com/solnx/hurricane/internal/intf"
+	"github.com/solnx/hurricane/internal/reorder"
+	"github.com/solnx/legacy"
+)
+
+// unit implements the logic to compute the derived metric of a rule
+// for one group of one asset
+type unit struct {
+	rule     *Rule
+	assetID  int64
+	group    string
+	curr     cycle
+	currTime time.Time
+	lookup   intf.TagLookup
+	ack      []*erebos.Transport
+	pending  []intf.Offset
+	lastSeen time.Time
+	buffer   *reorder.Buffer
+}
+
+// update adds value v of m to the measurement cycle of m tracked by u
+func (u *unit) update(m *legacy.MetricSplit, t *erebos.Transport, v float64) ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	// track activity for the eviction of idle state
+	u.lastSeen = time.Now()
+
+	// redelivery of a message that is part of the restored state
+	pending, claimed := intf.Claim(u.pending, t)
+	u.pending = pending
+	if claimed {
+		u.ack = append(u.ack, t)
+		return nil, nil, false, nil
+	}
+
+	// metric for a measurement cycle that was already evaluated
+	if !u.currTime.IsZero() && !m.TS.After(u.currTime) {
+		return []*legacy.MetricSplit{}, []*erebos.Transport{t}, true, nil
+	}
+
+	e := u.buffer.Get(m.TS, func() interface{} {
+		return cycle{}
+	})
+	e.Value.(cycle)[m.Path] = v
+	e.Acks = append(e.Acks, t)
+
+	// cycles that fell out of the reorder window are abandoned
+	abandoned := u.buffer.Trim()
+
+	derived, acks, ok, err := u.evaluate()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if len(abandoned) > 0 {
+		return derived, append(acks, abandoned...), true, nil
+	}
+	return derived, acks, ok, nil
+}
+
+// evaluate calculates the derived metrics for all complete cycles at
+// the start of the reorder buffer in timestamp order. Evaluation stops
+// at the first incomplete cycle.
+func (u *unit) evaluate() ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var ok bool
+
+	for e := u.buffer.Oldest(); e != nil && e.Value.(cycle).valid(u.rule); e = u.buffer.Oldest() {
+		u.buffer.Pop()
+		u.ack = append(u.ack, e.Acks...)
+
+		m, a, done, err := u.calculate(e.Value.(cycle), e.TS)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if done {
+			derived = append(derived, m...)
+			acks = append(acks, a...)
+			ok = true
+		}
+	}
+	return derived, acks, ok, nil
+}
+
+// calculate applies the rule to the complete cycle next, moves the
+// cycles forward and returns the derived metric. The first cycle of
+// operations that require a previous cycle returns nil.
+func (u *unit) calculate(next cycle, nextTime time.Time) ([]*legacy.MetricSplit, []*erebos.Transport, bool, error) {
+	// this is the first update
+	if u.currTime.IsZero() && u.rule.stateful() {
+		u.curr = next
+		u.currTime = nextTime
+		return nil, nil, false, nil
+	}
+
+	result, valid := u.rule.apply(u.curr, u.currTime, next, nextTime)
+	u.curr = next
+	u.currTime = nextTime
+
+	derived := []*legacy.MetricSplit{}
+	if valid {
+		var err error
+		if derived, err = u.emitMetric(result); err != nil {
+			return nil, nil, false, err
+		}
+	}
+	acks := u.ack
+	u.ack = []*erebos.Transport{}
+	return derived, acks, true, nil
+}
+
+// expire gives up on all cycles in the reorder buffer that were
+// started before deadline and are still incomplete. If partial is
+// set, missing values are carried over from the current cycle and the
+// result is evaluated. Otherwise, or if the result can still not be
+// evaluated, the cycle is dropped and its acknowledgements are
+// released. It returns the number of dropped and partially evaluated
+// cycles.
+func (u *unit) expire(deadline time.Time, partial bool) ([]*legacy.MetricSplit, []*erebos.Transport, int, int, error) {
+	derived := []*legacy.MetricSplit{}
+	acks := []*erebos.Transport{}
+	var dropped, evaluated int
+
+	for e := u.buffer.Oldest(); e != nil && e.Start.Before(deadline); e = u.buffer.Oldest() {
+		u.buffer.Pop()
+		next := e.Value.(cycle)
+		if !next.valid(u.rule) && partial && !u.currTime.IsZero() {
+			next.fill(u.curr)
+			if next.valid(u.rule) {
+				evaluated++
+			}
+		}
+		if !next.valid(u.rule) {
+			acks = append(acks, e.Acks...)
+			dropped++
+			continue
+		}
+
+		u.ack = append(u.ack, e.Acks...)
+		m, a, ok, err := u.calculate(next, e.TS)
+		if err != nil {
+			return nil, nil, 0, 0, err
+		}
+		if ok {
+			derived = append(derived, m...)
+			acks = append(acks, a...)
+		}
+	}
+
+	m, a, _, err := u.evaluate()
+	if err != nil {
+		return nil, nil, 0, 0, err
+	}
+	derived = append(derived, m...)
+	acks = append(acks, a...)
+	return derived, acks, dropped, evaluated, nil
+}
+
+// outstanding returns all acknowledgements held by u
+func (u *unit) outstanding() []*erebos.Transport {
+	return append(u.buffer.Acks(), u.ack...)
+}
+
+// emitMetric returns the derived metric with value v for the current
+// cycle
+func (u *unit) emitMetric(v float64) ([]*legacy.MetricSplit, error) {
+	res := &legacy.MetricSplit{
+		AssetID: u.assetID,
+		Path:    u.rule.output(u.group),
+		TS:      u.currTime,
+		Type:    u.rule.valueType,
+		Unit:    u.rule.unit,
+	}
+	switch u.rule.valueType {
+	case `integer`:
+		res.Val.IntVal = int64(math.Floor(v + .5))
+	default:
+		res.Val.FlpVal = v
+	}
+
+	result := []*legacy.MetricSplit{res}
+	if err := intf.LookupTags(u.lookup, result); err != nil {
+		// do not emit potentially incorrect metrics
+		return []*legacy.MetricSplit{}, err
+	}
+	return result, nil
+}
+
+// vim: ts=4 sw=4 sts=4 noet fenc=utf-8 ffs=unix